@@ -0,0 +1,207 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsconsensus"
+)
+
+// Entry is one allocated address, as reported by [ConsensusIPPool.Dump].
+type Entry struct {
+	Addr           netip.Addr
+	Domain         string
+	LastUsed       time.Time
+	LeaseRemaining time.Duration // may be negative, if the lease is expired but not yet reaped
+}
+
+// Dump returns every address currently allocated to nid, for admin/introspection use. Unlike
+// the rest of this package, it's safe to call from any goroutine: it reads addrToDomain through
+// its own concurrent map, not through Apply.
+func (ipp *ConsensusIPPool) Dump(nid tailcfg.NodeID) ([]Entry, error) {
+	ps, ok := ipp.perPeerMap.Load(nid)
+	if !ok {
+		return nil, fmt.Errorf("ippool: no state for node %v", nid)
+	}
+	now := time.Now()
+	var entries []Entry
+	ps.addrToDomain.Range(func(addr netip.Addr, ww whereWhen) bool {
+		entries = append(entries, Entry{
+			Addr:           addr,
+			Domain:         ww.Domain,
+			LastUsed:       ww.LastUsed,
+			LeaseRemaining: ww.LastUsed.Add(ipp.config.ReuseDeadline).Sub(now),
+		})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Addr.Compare(entries[j].Addr) < 0 })
+	return entries, nil
+}
+
+// FamilyCounts breaks down a slice of the pool down into allocated, free and expired address
+// counts, as reported by [ConsensusIPPool.Stats].
+type FamilyCounts struct {
+	Allocated uint64 // addresses with a live entry in addrToDomain
+	Expired   uint64 // subset of Allocated whose lease has already expired
+	Free      uint64 // addresses never allocated, or reaped and returned to the free set
+}
+
+// PoolStats summarizes the pool's address usage, as reported by [ConsensusIPPool.Stats].
+//
+// There's no single "total minus allocated" free count for the pool as a whole: per
+// applyCheckoutAddr's doc, every peer can draw from the entire address range independently,
+// so the same address range is each peer's own to exhaust. ByFamily.Free and ByPeer.Free are
+// therefore each peer's own (family total - that peer's own allocations), summed across peers
+// for ByFamily; they report how close each peer individually is to exhausting the pool, not
+// how much of a shared range is left.
+type PoolStats struct {
+	ByFamily map[AddressFamily]FamilyCounts
+	ByPeer   map[tailcfg.NodeID]FamilyCounts
+}
+
+// Stats computes a point-in-time summary of the pool's address usage across every peer.
+func (ipp *ConsensusIPPool) Stats() PoolStats {
+	v4Total, v6Total := ipp.v4Total, ipp.v6Total
+
+	stats := PoolStats{
+		// Pre-seeded so both families are always present, even with no peers yet: an admin
+		// endpoint shouldn't make callers special-case "no data" vs. "zero everything".
+		ByFamily: map[AddressFamily]FamilyCounts{
+			AddressFamilyIPv4: {},
+			AddressFamilyIPv6: {},
+		},
+		ByPeer: map[tailcfg.NodeID]FamilyCounts{},
+	}
+	now := time.Now()
+	ipp.perPeerMap.Range(func(nid tailcfg.NodeID, ps *consensusPerPeerState) bool {
+		var peerV4, peerV6 FamilyCounts
+		ps.addrToDomain.Range(func(addr netip.Addr, ww whereWhen) bool {
+			fc := &peerV4
+			if !addr.Is4() {
+				fc = &peerV6
+			}
+			fc.Allocated++
+			if ww.LastUsed.Add(ipp.config.ReuseDeadline).Before(now) {
+				fc.Expired++
+			}
+			return true
+		})
+		peerV4.Free = satSub(v4Total, peerV4.Allocated)
+		peerV6.Free = satSub(v6Total, peerV6.Allocated)
+
+		byFamily := stats.ByFamily[AddressFamilyIPv4]
+		byFamily.Allocated += peerV4.Allocated
+		byFamily.Expired += peerV4.Expired
+		byFamily.Free += peerV4.Free
+		stats.ByFamily[AddressFamilyIPv4] = byFamily
+
+		byFamily = stats.ByFamily[AddressFamilyIPv6]
+		byFamily.Allocated += peerV6.Allocated
+		byFamily.Expired += peerV6.Expired
+		byFamily.Free += peerV6.Free
+		stats.ByFamily[AddressFamilyIPv6] = byFamily
+
+		stats.ByPeer[nid] = FamilyCounts{
+			Allocated: peerV4.Allocated + peerV6.Allocated,
+			Expired:   peerV4.Expired + peerV6.Expired,
+			Free:      peerV4.Free + peerV6.Free,
+		}
+		return true
+	})
+	return stats
+}
+
+// satSub returns a-b, or 0 if that would underflow. allocated can exceed total transiently
+// (e.g. total shrinks because Config.AddressFamily was changed while peers already hold
+// addresses from the now-excluded family), and a huge wrapped uint64 is a worse answer than 0
+// for a metric operators alert on.
+func satSub(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+// LeaderInfo reports this node's view of the cluster, as reported by [ConsensusIPPool.LeaderInfo].
+type LeaderInfo struct {
+	IsLeader          bool
+	Leader            string // the leader's raft server address, or "" if unknown
+	AppliedIndex      uint64
+	LastSnapshotIndex uint64
+	SnapshotAge       time.Duration // since the last local Snapshot call; zero if none has happened yet
+}
+
+// LeaderInfo reports the current raft leader as this node sees it, this node's last applied
+// log index, and how long ago this node last took an FSM snapshot. It returns an error if
+// StartConsensus hasn't been called yet.
+//
+// This assumes tsconsensus.Consensus exposes a Raft() accessor returning the underlying
+// *raft.Raft, whose Leader() and Stats()["last_snapshot_index"] this function reads directly --
+// tsconsensus has no introspection API of its own for either.
+func (ipp *ConsensusIPPool) LeaderInfo() (LeaderInfo, error) {
+	cns, ok := ipp.consensus.(*tsconsensus.Consensus)
+	if !ok {
+		return LeaderInfo{}, fmt.Errorf("ippool: consensus not started")
+	}
+	r := cns.Raft()
+	info := LeaderInfo{
+		IsLeader:     ipp.isLeader.Load(),
+		Leader:       string(r.Leader()),
+		AppliedIndex: ipp.appliedIndex.get(),
+	}
+	if s, err := strconv.ParseUint(r.Stats()["last_snapshot_index"], 10, 64); err == nil {
+		info.LastSnapshotIndex = s
+	}
+	if nano := ipp.lastSnapshotUnixNano.Load(); nano != 0 {
+		info.SnapshotAge = time.Since(time.Unix(0, nano))
+	}
+	return info, nil
+}
+
+// DebugMux returns an [http.ServeMux] exposing this pool's state as JSON, for an embedder to
+// mount on its own admin/debug HTTP surface (including tsconsensus's debug monitor, if one is
+// already registered): GET /dump?nid=<id>, GET /stats, and GET /leader.
+func (ipp *ConsensusIPPool) DebugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dump", func(w http.ResponseWriter, r *http.Request) {
+		nid, err := strconv.ParseUint(r.URL.Query().Get("nid"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad or missing nid: %v", err), http.StatusBadRequest)
+			return
+		}
+		entries, err := ipp.Dump(tailcfg.NodeID(nid))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, entries)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, ipp.Stats())
+	})
+	mux.HandleFunc("/leader", func(w http.ResponseWriter, r *http.Request) {
+		info, err := ipp.LeaderInfo()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, info)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// TestDump checks that Dump reports every address allocated to a node, sorted by address, and
+// errors for a node with no state.
+func TestDump(t *testing.T) {
+	ipp := newTestPool(t)
+	nid := tailcfg.NodeID(1)
+	now := time.Now()
+	addr1, err := ipp.applyCheckoutAddr(nid, "a.example.com", now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr2, err := ipp.applyCheckoutAddr(nid, "b.example.com", now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ipp.Dump(nid)
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if !(entries[0].Addr.Compare(entries[1].Addr) < 0) {
+		t.Errorf("entries not sorted by address: %v, %v", entries[0].Addr, entries[1].Addr)
+	}
+	for _, e := range entries {
+		if e.Addr != addr1 && e.Addr != addr2 {
+			t.Errorf("unexpected address %v in dump", e.Addr)
+		}
+	}
+
+	if _, err := ipp.Dump(tailcfg.NodeID(999)); err == nil {
+		t.Error("Dump for unknown node: got nil error, want non-nil")
+	}
+}
+
+// TestStats checks that Stats counts allocated and expired addresses per family and per peer.
+func TestStats(t *testing.T) {
+	ipp := newTestPool(t)
+	ipp.config.ReuseDeadline = time.Minute
+	nid := tailcfg.NodeID(1)
+	now := time.Now()
+
+	if _, err := ipp.applyCheckoutAddr(nid, "expired.example.com", now.Add(-48*time.Hour), now.Add(-2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipp.applyCheckoutAddr(nid, "fresh.example.com", now.Add(-48*time.Hour), now); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := ipp.Stats()
+	fc := stats.ByFamily[AddressFamilyIPv4]
+	if fc.Allocated != 2 {
+		t.Errorf("ByFamily[IPv4].Allocated = %d, want 2", fc.Allocated)
+	}
+	if fc.Expired != 1 {
+		t.Errorf("ByFamily[IPv4].Expired = %d, want 1", fc.Expired)
+	}
+	wantFree := uint64(256 - 2) // newTestPool's /24, minus this peer's 2 allocations
+	if fc.Free != wantFree {
+		t.Errorf("ByFamily[IPv4].Free = %d, want %d", fc.Free, wantFree)
+	}
+	peer := stats.ByPeer[nid]
+	if peer.Allocated != 2 || peer.Expired != 1 {
+		t.Errorf("ByPeer[nid] = %+v, want Allocated 2, Expired 1", peer)
+	}
+	if peer.Free != wantFree {
+		t.Errorf("ByPeer[nid].Free = %d, want %d", peer.Free, wantFree)
+	}
+}
+
+// TestStatsEmptyPool checks that Stats reports both families even before any peer has checked
+// out an address, instead of an empty ByFamily map that callers would have to special-case.
+func TestStatsEmptyPool(t *testing.T) {
+	ipp := newTestPool(t)
+	stats := ipp.Stats()
+	if _, ok := stats.ByFamily[AddressFamilyIPv4]; !ok {
+		t.Error("ByFamily missing AddressFamilyIPv4 entry for an empty pool")
+	}
+	if _, ok := stats.ByFamily[AddressFamilyIPv6]; !ok {
+		t.Error("ByFamily missing AddressFamilyIPv6 entry for an empty pool")
+	}
+}
+
+// TestStatsMultiplePeersDontUnderflowFree checks that, since every peer can draw from the whole
+// pool independently (see applyCheckoutAddr's doc), allocations by separate peers that together
+// exceed the pool's size don't underflow Free into a huge wrapped uint64 -- each peer's Free is
+// its own total minus its own allocations, not a total shared across peers.
+func TestStatsMultiplePeersDontUnderflowFree(t *testing.T) {
+	ipp := newTestPool(t) // a /24: 256 addresses
+	now := time.Now()
+	for _, nid := range []tailcfg.NodeID{1, 2} {
+		for i := 0; i < 200; i++ {
+			if _, err := ipp.applyCheckoutAddr(nid, fmt.Sprintf("host-%d.example.com", i), now.Add(-time.Hour), now); err != nil {
+				t.Fatalf("peer %d, checkout %d: %v", nid, i, err)
+			}
+		}
+	}
+
+	stats := ipp.Stats()
+	fc := stats.ByFamily[AddressFamilyIPv4]
+	if fc.Allocated != 400 {
+		t.Errorf("ByFamily[IPv4].Allocated = %d, want 400", fc.Allocated)
+	}
+	const wantPeerFree = uint64(256 - 200)
+	if fc.Free != 2*wantPeerFree {
+		t.Errorf("ByFamily[IPv4].Free = %d, want %d", fc.Free, 2*wantPeerFree)
+	}
+	for _, nid := range []tailcfg.NodeID{1, 2} {
+		if got := stats.ByPeer[nid].Free; got != wantPeerFree {
+			t.Errorf("ByPeer[%d].Free = %d, want %d", nid, got, wantPeerFree)
+		}
+	}
+}
+
+// TestLeaderInfoNotStarted checks that LeaderInfo errors before StartConsensus has run, since
+// there's no raft cluster yet to report on.
+func TestLeaderInfoNotStarted(t *testing.T) {
+	ipp := newTestPool(t)
+	if _, err := ipp.LeaderInfo(); err == nil {
+		t.Error("LeaderInfo before StartConsensus: got nil error, want non-nil")
+	}
+}
+
+// TestDebugMux checks that DebugMux's routes respond, covering both the happy path and the
+// error paths for bad input.
+func TestDebugMux(t *testing.T) {
+	ipp := newTestPool(t)
+	nid := tailcfg.NodeID(1)
+	now := time.Now()
+	if _, err := ipp.applyCheckoutAddr(nid, "example.com", now.Add(-time.Hour), now); err != nil {
+		t.Fatal(err)
+	}
+	mux := ipp.DebugMux()
+
+	cases := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/dump?nid=1", 200},
+		{"/dump", 400},
+		{"/dump?nid=999", 404},
+		{"/stats", 200},
+		{"/leader", 503}, // consensus never started in this test
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("GET %s: status = %d, want %d", tc.path, rec.Code, tc.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"time"
+
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+// addrSpace flattens an [netipx.IPSet]'s ranges into a single contiguous space of offsets, so
+// that an address can be named by a uint64 offset instead of walked to one byte-comparison at a
+// time. It works for both IPv4 and IPv6 ranges, as long as each IPv6 range lies within a single
+// /64 and is smaller than it (all of IPv4 always fits); see newAddrSpace.
+type addrSpace struct {
+	ranges []addrSpaceRange // ascending, by base
+	total  uint64
+}
+
+type addrSpaceRange struct {
+	from netip.Addr
+	base uint64 // offset of 'from' in the flattened space
+	size uint64
+}
+
+// newAddrSpace builds the flattened offset space for ipset, restricted to family (AddressFamilyAny
+// includes every range). It's computed once per ConsensusIPPool, since neither the IPSet nor the
+// configured family change after the pool is created.
+//
+// It rejects any IPv6 range of a /64 or wider: addrLow64 only looks at the low 64 bits of an
+// address, so such a range either spans more than one distinct high-64-bits prefix (silently
+// wrong math) or, for a range that's exactly one /64, has exactly 2^64 addresses, one more than
+// a uint64 size can represent. Rather than let either case corrupt the space's total silently,
+// newAddrSpace errors instead.
+func newAddrSpace(ipset *netipx.IPSet, family AddressFamily) (*addrSpace, error) {
+	as := &addrSpace{}
+	for _, r := range ipset.Ranges() {
+		from, to := r.From(), r.To()
+		if !from.IsValid() || !to.IsValid() {
+			continue
+		}
+		switch family {
+		case AddressFamilyIPv4:
+			if !from.Is4() {
+				continue
+			}
+		case AddressFamilyIPv6:
+			if from.Is4() {
+				continue
+			}
+		}
+		if !from.Is4() && !sameHigh64(from, to) {
+			return nil, fmt.Errorf("ippool: IPv6 range %s-%s is wider than a /64, which isn't supported", from, to)
+		}
+		size := addrOffset(from, to) + 1
+		if size == 0 {
+			return nil, fmt.Errorf("ippool: IPv6 range %s-%s is a full /64 (2^64 addresses), which isn't supported", from, to)
+		}
+		as.ranges = append(as.ranges, addrSpaceRange{from: from, base: as.total, size: size})
+		as.total += size
+	}
+	return as, nil
+}
+
+// sameHigh64 reports whether a and b share the same high 64 bits of their 16-byte
+// representation, i.e. fall within the same /64.
+func sameHigh64(a, b netip.Addr) bool {
+	ab, bb := a.As16(), b.As16()
+	return binary.BigEndian.Uint64(ab[:8]) == binary.BigEndian.Uint64(bb[:8])
+}
+
+// offsetOf returns addr's position in the flattened space, and whether addr falls in the space
+// at all.
+func (as *addrSpace) offsetOf(addr netip.Addr) (uint64, bool) {
+	for _, r := range as.ranges {
+		size := addrDistanceOrMax(r.from, addr)
+		if size < r.size && sameFamily(r.from, addr) && sameHigh64(r.from, addr) {
+			return r.base + size, true
+		}
+	}
+	return 0, false
+}
+
+// addr returns the address at the given offset in the flattened space.
+func (as *addrSpace) addr(offset uint64) netip.Addr {
+	for _, r := range as.ranges {
+		if offset < r.base+r.size {
+			return addrAdd(r.from, offset-r.base)
+		}
+	}
+	return netip.Addr{}
+}
+
+func sameFamily(a, b netip.Addr) bool { return a.Is4() == b.Is4() }
+
+// addrDistanceOrMax returns b-a as a uint64, or the space's max uint64 if b is before a or in a
+// different family (so offsetOf's size comparison above always fails for it).
+func addrDistanceOrMax(a, b netip.Addr) uint64 {
+	if !sameFamily(a, b) {
+		return ^uint64(0)
+	}
+	av, bv := addrLow64(a), addrLow64(b)
+	if bv < av {
+		return ^uint64(0)
+	}
+	return bv - av
+}
+
+// addrOffset returns b-a, the distance from a to b; a range from a to b inclusive holds
+// addrOffset(a, b)+1 addresses.
+func addrOffset(a, b netip.Addr) uint64 {
+	return addrLow64(b) - addrLow64(a)
+}
+
+// addrLow64 returns the low 64 bits of addr's 16-byte representation. Every address this
+// package deals with within a single addrSpaceRange shares the same high 64 bits (true for any
+// real-world IPv4 range, or an IPv6 range no larger than a /64), so the low 64 bits alone are
+// enough to order and add within a range.
+func addrLow64(addr netip.Addr) uint64 {
+	b := addr.As16()
+	return binary.BigEndian.Uint64(b[8:])
+}
+
+// addrAdd returns the address delta past base, within base's /64 (or, for IPv4, within its
+// /0 -- the whole 32-bit space lives in the low 64 bits of the IPv4-mapped form).
+func addrAdd(base netip.Addr, delta uint64) netip.Addr {
+	b := base.As16()
+	v := binary.BigEndian.Uint64(b[8:]) + delta
+	binary.BigEndian.PutUint64(b[8:], v)
+	full := netip.AddrFrom16(b)
+	if base.Is4() {
+		return full.Unmap()
+	}
+	return full
+}
+
+// offsetRange is a half-open [start, end) range of offsets into an addrSpace.
+type offsetRange struct {
+	start, end uint64
+}
+
+// freeSet tracks which offsets into an addrSpace haven't been allocated yet, as a sorted list
+// of disjoint free ranges. Unlike scanning the address space for the next free entry, take and
+// pickRandom cost time proportional to the number of distinct free ranges, not to the size of
+// the address space -- which is what made allocation pathological for large IPv6 pools.
+type freeSet struct {
+	ranges []offsetRange // sorted ascending, disjoint
+}
+
+func newFreeSet(total uint64) *freeSet {
+	if total == 0 {
+		return &freeSet{}
+	}
+	return &freeSet{ranges: []offsetRange{{0, total}}}
+}
+
+// take removes offset from the free set. It reports whether offset was free.
+func (f *freeSet) take(offset uint64) bool {
+	for i, r := range f.ranges {
+		if offset < r.start || offset >= r.end {
+			continue
+		}
+		switch {
+		case r.start == offset && r.end == offset+1:
+			f.ranges = append(f.ranges[:i], f.ranges[i+1:]...)
+		case r.start == offset:
+			f.ranges[i].start++
+		case r.end == offset+1:
+			f.ranges[i].end--
+		default:
+			left, right := offsetRange{r.start, offset}, offsetRange{offset + 1, r.end}
+			f.ranges = append(f.ranges[:i:i], append([]offsetRange{left, right}, f.ranges[i+1:]...)...)
+		}
+		return true
+	}
+	return false
+}
+
+// free returns offset to the free set, merging it with adjacent free ranges if any.
+func (f *freeSet) free(offset uint64) {
+	idx := sort.Search(len(f.ranges), func(i int) bool { return f.ranges[i].start > offset })
+	merged := offsetRange{offset, offset + 1}
+	if idx > 0 && f.ranges[idx-1].end == offset {
+		merged.start = f.ranges[idx-1].start
+		idx--
+		f.ranges = append(f.ranges[:idx], f.ranges[idx+1:]...)
+	}
+	if idx < len(f.ranges) && f.ranges[idx].start == merged.end {
+		merged.end = f.ranges[idx].end
+		f.ranges = append(f.ranges[:idx], f.ranges[idx+1:]...)
+	}
+	f.ranges = append(f.ranges, offsetRange{})
+	copy(f.ranges[idx+1:], f.ranges[idx:])
+	f.ranges[idx] = merged
+}
+
+// takeLowest removes and returns the lowest free offset. It reports false if the free set is
+// empty.
+func (f *freeSet) takeLowest() (uint64, bool) {
+	if len(f.ranges) == 0 {
+		return 0, false
+	}
+	offset := f.ranges[0].start
+	f.take(offset)
+	return offset, true
+}
+
+// pickRandom picks a uniformly random free offset, weighted by each free range's size, removes
+// it from the free set, and returns it. It reports false if the free set is empty.
+func (f *freeSet) pickRandom(rng *rand.Rand) (uint64, bool) {
+	var total uint64
+	for _, r := range f.ranges {
+		total += r.end - r.start
+	}
+	if total == 0 {
+		return 0, false
+	}
+	n := uint64(rng.Int63n(int64(total)))
+	var cum uint64
+	for _, r := range f.ranges {
+		size := r.end - r.start
+		if n < cum+size {
+			offset := r.start + (n - cum)
+			f.take(offset)
+			return offset, true
+		}
+		cum += size
+	}
+	return 0, false // unreachable: n < total
+}
+
+// allocSeed derives a deterministic PRNG seed from a checkout's identity. Every replica applies
+// the same checkoutAddr command with the same (nid, domain, updatedAt), so they all derive the
+// same seed and therefore make the same pseudo-random address choice -- required for the FSM to
+// stay deterministic across replicas.
+//
+// This deliberately uses hash/fnv rather than hash/maphash: maphash.Seed can only be constructed
+// via maphash.MakeSeed, which is randomized per process, so every replica (and every restart of
+// the same node) would hash (nid, domain, updatedAt) to a different value and diverge on an
+// identical checkoutAddr entry. fnv has no such per-process seed.
+func allocSeed(nid tailcfg.NodeID, domain string, updatedAt time.Time) int64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(nid))
+	h.Write(buf[:])
+	h.Write([]byte(domain))
+	binary.BigEndian.PutUint64(buf[:], uint64(updatedAt.UnixNano()))
+	h.Write(buf[:])
+	return int64(h.Sum64())
+}
@@ -0,0 +1,265 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+func TestFreeSetTakeFreePickRandom(t *testing.T) {
+	f := newFreeSet(10)
+	rng := rand.New(rand.NewSource(1))
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < 10; i++ {
+		offset, ok := f.pickRandom(rng)
+		if !ok {
+			t.Fatalf("pickRandom failed on iteration %d, free set should have %d left", i, 10-i)
+		}
+		if seen[offset] {
+			t.Fatalf("pickRandom returned offset %d twice", offset)
+		}
+		seen[offset] = true
+	}
+	if _, ok := f.pickRandom(rng); ok {
+		t.Fatal("pickRandom succeeded on an exhausted free set")
+	}
+
+	f.free(3)
+	f.free(4)
+	f.free(5)
+	if ok := f.take(4); !ok {
+		t.Fatal("take(4) failed after free(4)")
+	}
+	if ok := f.take(4); ok {
+		t.Fatal("take(4) succeeded twice")
+	}
+	// 3, 4 and 5 merged into one free range; retaking 4 splits it into two single-offset ranges.
+	if len(f.ranges) != 2 {
+		t.Fatalf("got %d free ranges, want 2: %v", len(f.ranges), f.ranges)
+	}
+}
+
+func TestAddrSpaceRoundTrip(t *testing.T) {
+	cases := []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.0/24"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::/112"),
+	}
+	for _, prefix := range cases {
+		t.Run(prefix.String(), func(t *testing.T) {
+			var b netipx.IPSetBuilder
+			b.AddPrefix(prefix)
+			ipSet, err := b.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			as, err := newAddrSpace(ipSet, AddressFamilyAny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantTotal := uint64(1) << (prefix.Addr().BitLen() - prefix.Bits())
+			if as.total != wantTotal {
+				t.Fatalf("total = %d, want %d", as.total, wantTotal)
+			}
+			for _, offset := range []uint64{0, 1, wantTotal / 2, wantTotal - 1} {
+				addr := as.addr(offset)
+				got, ok := as.offsetOf(addr)
+				if !ok || got != offset {
+					t.Errorf("offset %d: addr %v round-tripped to (%d, %v)", offset, addr, got, ok)
+				}
+			}
+		})
+	}
+}
+
+// TestNewAddrSpaceRejectsWideIPv6Ranges checks that newAddrSpace errors instead of silently
+// returning a zero or wrong total for an IPv6 range of a /64 or wider, since addrLow64 can only
+// order and add addresses correctly within a single /64.
+func TestNewAddrSpaceRejectsWideIPv6Ranges(t *testing.T) {
+	for _, prefix := range []string{"fd7a:115c:a1e0::/64", "fd7a:115c:a1e0::/56", "fd7a:115c:a1e0::/48"} {
+		t.Run(prefix, func(t *testing.T) {
+			var b netipx.IPSetBuilder
+			b.AddPrefix(netip.MustParsePrefix(prefix))
+			ipSet, err := b.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := newAddrSpace(ipSet, AddressFamilyAny); err == nil {
+				t.Errorf("newAddrSpace(%s): got nil error, want non-nil", prefix)
+			}
+		})
+	}
+}
+
+// TestApplyCheckoutAddrIPv6Pool checks that checkouts against an IPv6 pool allocate distinct
+// addresses drawn from the prefix, exercising the same addrSpace/freeSet path used for IPv4.
+func TestApplyCheckoutAddrIPv6Pool(t *testing.T) {
+	var b netipx.IPSetBuilder
+	b.AddPrefix(netip.MustParsePrefix("fd7a:115c:a1e0::/112"))
+	ipSet, err := b.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipp, err := NewConsensusIPPool(ipSet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nid := tailcfg.NodeID(1)
+	now := time.Now()
+
+	const n = 2000
+	seen := make(map[netip.Addr]bool, n)
+	for i := 0; i < n; i++ {
+		addr, err := ipp.applyCheckoutAddr(nid, fmt.Sprintf("host-%d.example.com", i), now.Add(-time.Hour), now)
+		if err != nil {
+			t.Fatalf("checkout %d: %v", i, err)
+		}
+		if !addr.Is6() {
+			t.Fatalf("checkout %d: got %v, want an IPv6 address", i, addr)
+		}
+		if seen[addr] {
+			t.Fatalf("checkout %d: address %v allocated twice", i, addr)
+		}
+		seen[addr] = true
+	}
+}
+
+// TestUnusedIPAllocationStrategies checks that each AllocationStrategy drives a distinguishable
+// allocation policy: sequential picks offsets in ascending order, and lru always reclaims the
+// single existing address instead of growing into the free pool.
+func TestUnusedIPAllocationStrategies(t *testing.T) {
+	var b netipx.IPSetBuilder
+	b.AddPrefix(netip.MustParsePrefix("100.64.0.0/24"))
+	ipSet, err := b.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.AllocationStrategy = AllocationStrategySequential
+		ipp, err := NewConsensusIPPool(ipSet, &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nid := tailcfg.NodeID(1)
+		now := time.Now()
+		var prev netip.Addr
+		for i := 0; i < 5; i++ {
+			addr, err := ipp.applyCheckoutAddr(nid, fmt.Sprintf("host-%d.example.com", i), now.Add(-time.Hour), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i > 0 && addr.Compare(prev) <= 0 {
+				t.Fatalf("checkout %d: got %v, want an address after %v", i, addr, prev)
+			}
+			prev = addr
+		}
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.AllocationStrategy = AllocationStrategyLRU
+		cfg.ReuseDeadline = time.Minute
+		ipp, err := NewConsensusIPPool(ipSet, &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nid := tailcfg.NodeID(1)
+		now := time.Now()
+
+		first, err := ipp.applyCheckoutAddr(nid, "a.example.com", now.Add(-2*time.Minute), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// b.example.com's checkout should reclaim "a"'s address rather than allocate a fresh
+		// one from the pool's 255 other free addresses, since AllocationStrategyLRU always
+		// prefers reuse.
+		second, err := ipp.applyCheckoutAddr(nid, "b.example.com", now.Add(-2*time.Minute), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second != first {
+			t.Fatalf("lru strategy allocated a fresh address %v instead of reclaiming %v", second, first)
+		}
+	})
+}
+
+// BenchmarkApplyCheckoutAddrIPv6Pool guards against the allocator regressing back to a scan
+// over the address space: a /112 has 65536 addresses, and unusedIP should pick among them in
+// time proportional to the number of free ranges, not to the size of the pool.
+func BenchmarkApplyCheckoutAddrIPv6Pool(b *testing.B) {
+	var builder netipx.IPSetBuilder
+	builder.AddPrefix(netip.MustParsePrefix("fd7a:115c:a1e0::/112"))
+	ipSet, err := builder.IPSet()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ipp, err := NewConsensusIPPool(ipSet, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	nid := tailcfg.NodeID(1)
+	now := time.Now()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ipp.applyCheckoutAddr(nid, fmt.Sprintf("host-%d.example.com", i%60000), now.Add(-time.Hour), now); err != nil {
+			b.Fatalf("checkout %d: %v", i, err)
+		}
+	}
+}
+
+// hashWithProcessRandomSeed mimics what allocSeed would compute if it used maphash.MakeSeed
+// instead of a fixed algorithm: a new, process-random maphash.Seed every time it's called. It
+// exists only to demonstrate, below, why allocSeed must not do this.
+func hashWithProcessRandomSeed(nid tailcfg.NodeID, domain string, updatedAt time.Time) int64 {
+	var h maphash.Hash
+	h.SetSeed(maphash.MakeSeed())
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(nid))
+	h.Write(buf[:])
+	h.Write([]byte(domain))
+	binary.BigEndian.PutUint64(buf[:], uint64(updatedAt.UnixNano()))
+	h.Write(buf[:])
+	return int64(h.Sum64())
+}
+
+// TestAllocSeedDeterministicAcrossReplicas checks that allocSeed, which every replica calls
+// independently when applying the same checkoutAddr log entry, returns the same value every
+// time for the same (nid, domain, updatedAt) -- and demonstrates, via
+// hashWithProcessRandomSeed, what goes wrong if it doesn't: a per-call/per-process-random seed
+// makes replicas pick different addresses for the identical command, silently diverging the
+// FSM.
+func TestAllocSeedDeterministicAcrossReplicas(t *testing.T) {
+	nid := tailcfg.NodeID(7)
+	domain := "example.com"
+	updatedAt := time.Unix(1700000000, 0)
+
+	// Simulate what a process-random seed would do: two independent "replicas" computing the
+	// seed for the identical command disagree.
+	a := hashWithProcessRandomSeed(nid, domain, updatedAt)
+	b := hashWithProcessRandomSeed(nid, domain, updatedAt)
+	if a == b {
+		t.Skip("hashWithProcessRandomSeed coincidentally agreed across two calls; flaky by construction, not a real failure")
+	}
+
+	// The real allocSeed has no such per-call randomness: every "replica" (here, every call)
+	// reaches the same value for the same input.
+	want := allocSeed(nid, domain, updatedAt)
+	for i := 0; i < 10; i++ {
+		if got := allocSeed(nid, domain, updatedAt); got != want {
+			t.Fatalf("allocSeed(%v, %q, %v) = %d on call %d, want %d (matching the first call)", nid, domain, updatedAt, got, i, want)
+		}
+	}
+}
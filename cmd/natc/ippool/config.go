@@ -0,0 +1,260 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// AllocationStrategy selects how [ConsensusIPPool.unusedIP] picks an address for a new
+// checkout.
+type AllocationStrategy string
+
+const (
+	// AllocationStrategyRandom picks a uniformly random free address (never allocated, or
+	// reaped and returned to the free set), falling back
+	// to the oldest expired lease once the pool's free addresses are exhausted. This is the
+	// default, and what an empty AllocationStrategy means.
+	AllocationStrategyRandom AllocationStrategy = "random"
+	// AllocationStrategySequential picks the lowest-numbered free address first,
+	// with the same lease-based fallback as AllocationStrategyRandom. Useful when operators
+	// want allocations to be easy to predict or eyeball in a small pool.
+	AllocationStrategySequential AllocationStrategy = "sequential"
+	// AllocationStrategyLRU always reclaims the least-recently-used address instead of handing
+	// out a free one, even when the pool isn't full. This favors a small, stable
+	// working set of addresses over spreading allocations across the whole pool.
+	AllocationStrategyLRU AllocationStrategy = "lru"
+)
+
+// valid reports whether s is empty (meaning AllocationStrategyRandom) or a recognized strategy.
+func (s AllocationStrategy) valid() bool {
+	switch s {
+	case "", AllocationStrategyRandom, AllocationStrategySequential, AllocationStrategyLRU:
+		return true
+	}
+	return false
+}
+
+// AddressFamily restricts which addresses in the pool's [go4.org/netipx.IPSet] are eligible for
+// allocation.
+type AddressFamily string
+
+const (
+	// AddressFamilyAny allocates from both IPv4 and IPv6 ranges in the pool's IPSet. This is
+	// the default, and what an empty AddressFamily means.
+	AddressFamilyAny  AddressFamily = ""
+	AddressFamilyIPv4 AddressFamily = "ipv4"
+	AddressFamilyIPv6 AddressFamily = "ipv6"
+)
+
+func (f AddressFamily) valid() bool {
+	switch f {
+	case AddressFamilyAny, AddressFamilyIPv4, AddressFamilyIPv6:
+		return true
+	}
+	return false
+}
+
+// RaftOverrides holds the subset of tsconsensus/raft tuning that [ConsensusIPPool.StartConsensus]
+// applies on top of [tsconsensus.DefaultConfig], so an embedder can set them from the same
+// [Config] blob used to build the pool itself instead of threading a second set of knobs through
+// StartConsensus.
+type RaftOverrides struct {
+	// ServeDebugMonitor enables tsconsensus's built-in HTTP debug monitor.
+	ServeDebugMonitor bool
+	// SnapshotInterval is how often raft checks whether it's time to take a new FSM snapshot;
+	// see Snapshot/Restore in snapshot.go.
+	SnapshotInterval time.Duration
+	// SnapshotThreshold is the minimum number of log entries since the last snapshot before
+	// raft will take a new one.
+	SnapshotThreshold uint64
+	// TrailingLogs is how many log entries raft keeps after a snapshot, so a slightly-behind
+	// follower can catch up without needing a full snapshot transfer.
+	TrailingLogs uint64
+}
+
+// Config holds the tunables for a [ConsensusIPPool], component-style: one JSON-marshalable
+// struct covering both the pool's own allocation policy and the tsconsensus/raft knobs it
+// drives, so an embedder can load a single config blob and have it configure both layers
+// consistently. The zero value is not valid on its own; use [DefaultConfig] and override only
+// the fields that matter to the caller, or call Validate after populating one by hand.
+type Config struct {
+	// ReuseDeadline is how long an allocated address can go unused before it becomes eligible
+	// for reclamation, either lazily (if another domain wants an address and finds this one
+	// expired) or proactively (via the leader's lease reaper).
+	ReuseDeadline time.Duration
+	// RevokeTickInterval is how often the leader checks for, and proposes revocation of,
+	// expired leases.
+	RevokeTickInterval time.Duration
+	// AllocationStrategy selects how new addresses are picked; see the AllocationStrategy
+	// constants. The zero value means AllocationStrategyRandom.
+	AllocationStrategy AllocationStrategy
+	// AddressFamily restricts allocation to one address family; see the AddressFamily
+	// constants. The zero value means AddressFamilyAny.
+	AddressFamily AddressFamily
+	// Raft holds the tsconsensus/raft overrides StartConsensus applies.
+	Raft RaftOverrides
+
+	// RetryBaseDelay and RetryMax configured the exponential-backoff retry loop DomainForIP
+	// used to use to paper over the race between raft quorum-commit and local FSM-apply. That
+	// loop was replaced by an applied-index barrier (see AwaitAppliedIndex), so these are no
+	// longer read by anything; they're kept only so that config blobs written before that
+	// change still decode without error.
+	//
+	// Deprecated: no longer used.
+	RetryBaseDelay time.Duration `json:",omitempty"`
+	// Deprecated: no longer used.
+	RetryMax int `json:",omitempty"`
+}
+
+// DefaultConfig returns the Config used when [NewConsensusIPPool] is called with a nil config.
+func DefaultConfig() Config {
+	return Config{
+		ReuseDeadline:      48 * time.Hour,
+		RevokeTickInterval: 30 * time.Second,
+		AllocationStrategy: AllocationStrategyRandom,
+		AddressFamily:      AddressFamilyAny,
+		Raft: RaftOverrides{
+			ServeDebugMonitor: true,
+			SnapshotInterval:  2 * time.Minute,
+			SnapshotThreshold: 8192,
+			TrailingLogs:      10240,
+		},
+	}
+}
+
+// Validate reports whether c is usable, without mutating it. NewConsensusIPPool calls this on
+// its way in, so a hand-built Config with, say, a zero RevokeTickInterval fails fast there
+// instead of panicking later inside runLeaseReaper's time.NewTicker(0).
+func (c Config) Validate() error {
+	if c.ReuseDeadline <= 0 {
+		return fmt.Errorf("ippool: ReuseDeadline must be positive, got %v", c.ReuseDeadline)
+	}
+	if c.RevokeTickInterval <= 0 {
+		return fmt.Errorf("ippool: RevokeTickInterval must be positive, got %v", c.RevokeTickInterval)
+	}
+	if !c.AllocationStrategy.valid() {
+		return fmt.Errorf("ippool: unrecognized AllocationStrategy %q", c.AllocationStrategy)
+	}
+	if !c.AddressFamily.valid() {
+		return fmt.Errorf("ippool: unrecognized AddressFamily %q", c.AddressFamily)
+	}
+	return nil
+}
+
+// configJSON mirrors Config but with duration fields spelled as [time.Duration.String] output
+// (e.g. "48h0m0s") instead of raw nanoseconds, so a hand-edited config file stays readable.
+type configJSON struct {
+	ReuseDeadline      string             `json:"reuseDeadline"`
+	RevokeTickInterval string             `json:"revokeTickInterval"`
+	AllocationStrategy AllocationStrategy `json:"allocationStrategy,omitempty"`
+	AddressFamily      AddressFamily      `json:"addressFamily,omitempty"`
+	Raft               struct {
+		ServeDebugMonitor bool   `json:"serveDebugMonitor"`
+		SnapshotInterval  string `json:"snapshotInterval"`
+		SnapshotThreshold uint64 `json:"snapshotThreshold"`
+		TrailingLogs      uint64 `json:"trailingLogs"`
+	} `json:"raft"`
+	RetryBaseDelay string `json:"retryBaseDelay,omitempty"`
+	RetryMax       int    `json:"retryMax,omitempty"`
+}
+
+// MarshalJSON implements [json.Marshaler].
+func (c Config) MarshalJSON() ([]byte, error) {
+	var j configJSON
+	j.ReuseDeadline = c.ReuseDeadline.String()
+	j.RevokeTickInterval = c.RevokeTickInterval.String()
+	j.AllocationStrategy = c.AllocationStrategy
+	j.AddressFamily = c.AddressFamily
+	j.Raft.ServeDebugMonitor = c.Raft.ServeDebugMonitor
+	j.Raft.SnapshotInterval = c.Raft.SnapshotInterval.String()
+	j.Raft.SnapshotThreshold = c.Raft.SnapshotThreshold
+	j.Raft.TrailingLogs = c.Raft.TrailingLogs
+	j.RetryBaseDelay = c.RetryBaseDelay.String()
+	j.RetryMax = c.RetryMax
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements [json.Unmarshaler].
+func (c *Config) UnmarshalJSON(bs []byte) error {
+	var j configJSON
+	if err := json.Unmarshal(bs, &j); err != nil {
+		return err
+	}
+	var err error
+	if c.ReuseDeadline, err = parseDuration(j.ReuseDeadline); err != nil {
+		return fmt.Errorf("ippool: reuseDeadline: %w", err)
+	}
+	if c.RevokeTickInterval, err = parseDuration(j.RevokeTickInterval); err != nil {
+		return fmt.Errorf("ippool: revokeTickInterval: %w", err)
+	}
+	if c.Raft.SnapshotInterval, err = parseDuration(j.Raft.SnapshotInterval); err != nil {
+		return fmt.Errorf("ippool: raft.snapshotInterval: %w", err)
+	}
+	if c.RetryBaseDelay, err = parseDuration(j.RetryBaseDelay); err != nil {
+		return fmt.Errorf("ippool: retryBaseDelay: %w", err)
+	}
+	c.AllocationStrategy = j.AllocationStrategy
+	c.AddressFamily = j.AddressFamily
+	c.Raft.ServeDebugMonitor = j.Raft.ServeDebugMonitor
+	c.Raft.SnapshotThreshold = j.Raft.SnapshotThreshold
+	c.Raft.TrailingLogs = j.Raft.TrailingLogs
+	c.RetryMax = j.RetryMax
+	return nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Environment variables read by [Config.ApplyEnv].
+const (
+	envReuseDeadline      = "TS_IPPOOL_REUSE_DEADLINE"
+	envRevokeTickInterval = "TS_IPPOOL_REVOKE_TICK_INTERVAL"
+	envAllocationStrategy = "TS_IPPOOL_ALLOCATION_STRATEGY"
+	envAddressFamily      = "TS_IPPOOL_ADDRESS_FAMILY"
+)
+
+// ApplyEnv overrides c's fields from environment variables, for the operator overrides that
+// don't warrant a full config file edit: TS_IPPOOL_REUSE_DEADLINE and
+// TS_IPPOOL_REVOKE_TICK_INTERVAL (as [time.ParseDuration] strings), and
+// TS_IPPOOL_ALLOCATION_STRATEGY / TS_IPPOOL_ADDRESS_FAMILY (as the string constants above). Unset
+// variables leave the corresponding field unchanged.
+func (c *Config) ApplyEnv() error {
+	if v := os.Getenv(envReuseDeadline); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("ippool: %s: %w", envReuseDeadline, err)
+		}
+		c.ReuseDeadline = d
+	}
+	if v := os.Getenv(envRevokeTickInterval); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("ippool: %s: %w", envRevokeTickInterval, err)
+		}
+		c.RevokeTickInterval = d
+	}
+	if v := os.Getenv(envAllocationStrategy); v != "" {
+		s := AllocationStrategy(v)
+		if !s.valid() {
+			return fmt.Errorf("ippool: %s: unrecognized allocation strategy %q", envAllocationStrategy, v)
+		}
+		c.AllocationStrategy = s
+	}
+	if v := os.Getenv(envAddressFamily); v != "" {
+		f := AddressFamily(v)
+		if !f.valid() {
+			return fmt.Errorf("ippool: %s: unrecognized address family %q", envAddressFamily, v)
+		}
+		c.AddressFamily = f
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go4.org/netipx"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		mutate  func(*Config)
+		wantErr bool
+	}{
+		{"defaults", func(*Config) {}, false},
+		{"zero reuse deadline", func(c *Config) { c.ReuseDeadline = 0 }, true},
+		{"zero revoke tick", func(c *Config) { c.RevokeTickInterval = 0 }, true},
+		{"bad strategy", func(c *Config) { c.AllocationStrategy = "fifo" }, true},
+		{"bad family", func(c *Config) { c.AddressFamily = "ipv5" }, true},
+		{"explicit family and strategy", func(c *Config) {
+			c.AllocationStrategy = AllocationStrategyLRU
+			c.AddressFamily = AddressFamilyIPv6
+		}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tc.mutate(&c)
+			err := c.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestNewConsensusIPPoolValidatesConfig checks that NewConsensusIPPool rejects an invalid Config
+// itself, instead of letting an embedder who built one by hand (not via DefaultConfig) hit a
+// panic deep inside runLeaseReaper's time.NewTicker(0) the first time it starts.
+func TestNewConsensusIPPoolValidatesConfig(t *testing.T) {
+	var b netipx.IPSetBuilder
+	b.AddPrefix(netip.MustParsePrefix("100.64.0.0/24"))
+	ipSet, err := b.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg Config // zero value: invalid per Config's doc
+	if _, err := NewConsensusIPPool(ipSet, &cfg); err == nil {
+		t.Error("NewConsensusIPPool with a zero-value Config: got nil error, want non-nil")
+	}
+}
+
+func TestConfigJSONRoundTrip(t *testing.T) {
+	want := DefaultConfig()
+	want.AllocationStrategy = AllocationStrategySequential
+	want.AddressFamily = AddressFamilyIPv4
+	want.Raft.SnapshotThreshold = 1234
+
+	bs, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got Config
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got != want {
+		t.Errorf("round trip: got %+v, want %+v", got, want)
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	t.Setenv(envReuseDeadline, "72h")
+	t.Setenv(envAllocationStrategy, "lru")
+	t.Setenv(envAddressFamily, "ipv6")
+
+	c := DefaultConfig()
+	if err := c.ApplyEnv(); err != nil {
+		t.Fatalf("ApplyEnv: %v", err)
+	}
+	if c.ReuseDeadline != 72*time.Hour {
+		t.Errorf("ReuseDeadline = %v, want 72h", c.ReuseDeadline)
+	}
+	if c.AllocationStrategy != AllocationStrategyLRU {
+		t.Errorf("AllocationStrategy = %q, want lru", c.AllocationStrategy)
+	}
+	if c.AddressFamily != AddressFamilyIPv6 {
+		t.Errorf("AddressFamily = %q, want ipv6", c.AddressFamily)
+	}
+}
+
+func TestConfigApplyEnvRejectsInvalid(t *testing.T) {
+	t.Setenv(envAllocationStrategy, "bogus")
+	c := DefaultConfig()
+	if err := c.ApplyEnv(); err == nil {
+		t.Fatal("ApplyEnv accepted an invalid allocation strategy")
+	}
+}
@@ -4,12 +4,15 @@
 package ippool
 
 import (
+	"container/heap"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/netip"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/raft"
@@ -27,23 +30,82 @@ import (
 // The cluster maintains consistency, reads can be stale and writes can be unavailable if sufficient cluster
 // peers are unavailable.
 type ConsensusIPPool struct {
-	IPSet      *netipx.IPSet
-	perPeerMap *syncs.Map[tailcfg.NodeID, *consensusPerPeerState]
-	consensus  commandExecutor
+	IPSet        *netipx.IPSet
+	perPeerMap   *syncs.Map[tailcfg.NodeID, *consensusPerPeerState]
+	consensus    commandExecutor
+	config       Config
+	appliedIndex *appliedIndexTracker
+	addrSpace    *addrSpace
+
+	// v4Total and v6Total are each family's total address count across the whole of IPSet,
+	// regardless of config.AddressFamily; Stats reports both families even when the pool is
+	// configured to only allocate from one of them. They're computed once here, rather than by
+	// calling newAddrSpace again from Stats, so that an IPSet this constructor has already
+	// validated can't later fail inside a method that has no way to return the error.
+	v4Total, v6Total uint64
+
+	// isLeader and lastSnapshotUnixNano back LeaderInfo; see admin.go.
+	isLeader             atomic.Bool
+	lastSnapshotUnixNano atomic.Int64
 }
 
-func NewConsensusIPPool(ipSet *netipx.IPSet) *ConsensusIPPool {
-	return &ConsensusIPPool{
-		IPSet:      ipSet,
-		perPeerMap: &syncs.Map[tailcfg.NodeID, *consensusPerPeerState]{},
+// NewConsensusIPPool creates a ConsensusIPPool using config, or [DefaultConfig] if config is
+// nil. It returns an error if config doesn't pass [Config.Validate], or if ipSet contains an
+// IPv6 range of a /64 or wider (see [newAddrSpace]).
+func NewConsensusIPPool(ipSet *netipx.IPSet, config *Config) (*ConsensusIPPool, error) {
+	cfg := DefaultConfig()
+	if config != nil {
+		cfg = *config
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	as, err := newAddrSpace(ipSet, cfg.AddressFamily)
+	if err != nil {
+		return nil, err
 	}
+	v4Space, err := newAddrSpace(ipSet, AddressFamilyIPv4)
+	if err != nil {
+		return nil, err
+	}
+	v6Space, err := newAddrSpace(ipSet, AddressFamilyIPv6)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsensusIPPool{
+		IPSet:        ipSet,
+		perPeerMap:   &syncs.Map[tailcfg.NodeID, *consensusPerPeerState]{},
+		config:       cfg,
+		appliedIndex: newAppliedIndexTracker(),
+		addrSpace:    as,
+		v4Total:      v4Space.total,
+		v6Total:      v6Space.total,
+	}, nil
 }
 
 // DomainForIP is part of the IPPool interface. It returns a domain for a given IP address, if we have
 // previously assigned the IP address to a domain for the node that is asking. Otherwise it logs and returns the empty string.
-func (ipp *ConsensusIPPool) DomainForIP(from tailcfg.NodeID, addr netip.Addr, updatedAt time.Time) (string, bool) {
-	ww, ok := ipp.retryDomainLookup(from, addr, 0)
-	if !ok {
+//
+// minAppliedIndex, if nonzero, is a raft log index DomainForIP should wait to see applied
+// locally before giving up on a lookup, typically the index returned by an earlier IPForDomain
+// call for this same node+domain. This replaces sleeping and retrying to paper over the race
+// between raft reporting a write committed to a quorum and this node's local Apply catching up
+// to it: the caller waits only as long as that specific write actually takes, not a fixed
+// backoff schedule.
+func (ipp *ConsensusIPPool) DomainForIP(ctx context.Context, from tailcfg.NodeID, addr netip.Addr, updatedAt time.Time, minAppliedIndex uint64) (string, bool) {
+	if minAppliedIndex > 0 {
+		if err := ipp.appliedIndex.await(ctx, minAppliedIndex); err != nil {
+			log.Printf("DomainForIP: waiting for index %d to apply: %v", minAppliedIndex, err)
+		}
+	}
+	ps, foundPeerState := ipp.perPeerMap.Load(from)
+	if !foundPeerState {
+		log.Printf("DomainForIP: peer state absent for: %d", from)
+		return "", false
+	}
+	ww, foundDomain := ps.addrToDomain.Load(addr)
+	if !foundDomain {
+		log.Printf("DomainForIP: peer state doesn't recognize addr: %s", addr)
 		return "", false
 	}
 	go func() {
@@ -55,55 +117,44 @@ func (ipp *ConsensusIPPool) DomainForIP(from tailcfg.NodeID, addr netip.Addr, up
 	return ww.Domain, true
 }
 
-// retryDomainLookup tries to lookup the domain for this IP+node. If it can't find the node or the IP it
-// tries again up to 5 times, with exponential backoff.
-// The raft lib will tell the leader that a log entry has been applied to a quorum of nodes, sometimes before the
-// log entry has been applied to the local state. This means that in our case the traffic on an IP can arrive before
-// we have the domain for which that IP applies stored.
-func (ipp *ConsensusIPPool) retryDomainLookup(from tailcfg.NodeID, addr netip.Addr, n int) (whereWhen, bool) {
-	ps, foundPeerState := ipp.perPeerMap.Load(from)
-	if foundPeerState {
-		ww, foundDomain := ps.addrToDomain.Load(addr)
-		if foundDomain {
-			return ww, true
-		}
-	}
-	if n > 4 {
-		if !foundPeerState {
-			log.Printf("DomainForIP: peer state absent for: %d", from)
-		} else {
-			log.Printf("DomainForIP: peer state doesn't recognize addr: %s", addr)
-		}
-		return whereWhen{}, false
-	}
-	timeToWait := 100
-	for i := 0; i < n; i++ {
-		timeToWait *= 2
-	}
-	time.Sleep(time.Millisecond * time.Duration(timeToWait))
-	return ipp.retryDomainLookup(from, addr, n+1)
-}
-
 // StartConsensus is part of the IPPool interface. It starts the raft background routines that handle consensus.
+//
+// This assumes tsconsensus.Config has a Raft field exposing hashicorp/raft's own
+// SnapshotInterval, SnapshotThreshold and TrailingLogs knobs (i.e. it's a *raft.Config or
+// shaped like one) -- Config.Raft above exists precisely to thread user-facing copies of those
+// three through to here.
 func (ipp *ConsensusIPPool) StartConsensus(ctx context.Context, ts *tsnet.Server, clusterTag string) error {
 	cfg := tsconsensus.DefaultConfig()
-	cfg.ServeDebugMonitor = true
+	cfg.ServeDebugMonitor = ipp.config.Raft.ServeDebugMonitor
+	// Tune raft's snapshotting so the log is compacted periodically instead of growing
+	// unbounded; see Snapshot/Restore in snapshot.go.
+	cfg.Raft.SnapshotInterval = ipp.config.Raft.SnapshotInterval
+	cfg.Raft.SnapshotThreshold = ipp.config.Raft.SnapshotThreshold
+	cfg.Raft.TrailingLogs = ipp.config.Raft.TrailingLogs
 	cns, err := tsconsensus.Start(ctx, ts, ipp, clusterTag, cfg)
 	if err != nil {
 		return err
 	}
 	ipp.consensus = cns
+	go ipp.runLeaseReaper(ctx, cns)
 	return nil
 }
 
 type whereWhen struct {
 	Domain   string
 	LastUsed time.Time
+	LeaseID  leaseID
 }
 
 type consensusPerPeerState struct {
 	domainToAddr map[string]netip.Addr
 	addrToDomain *syncs.Map[netip.Addr, whereWhen]
+	leases       leaseHeap
+	nextLeaseID  uint64
+	// free tracks which offsets into the pool's addrSpace this peer hasn't allocated yet. It's
+	// created lazily, on this peer's first checkout, since most peers never need the whole
+	// pool's worth of bookkeeping.
+	free *freeSet
 }
 
 // StopConsensus is part of the IPPool interface. It stops the raft background routines that handle consensus.
@@ -111,47 +162,80 @@ func (ipp *ConsensusIPPool) StopConsensus(ctx context.Context) error {
 	return (ipp.consensus).(*tsconsensus.Consensus).Stop(ctx)
 }
 
-// unusedIPV4 finds the next unused or expired IP address in the pool.
-// IP addresses in the pool should be reused if they haven't been used for some period of time.
-// reuseDeadline is the time before which addresses are considered to be expired.
-// So if addresses are being reused after they haven't been used for 24 hours say, reuseDeadline
-// would be 24 hours ago.
-func (ps *consensusPerPeerState) unusedIPV4(ipset *netipx.IPSet, reuseDeadline time.Time) (netip.Addr, bool, string, error) {
-	// If we want to have a random IP choice behavior we could make that work with the state machine by doing something like
-	// passing the randomly chosen IP into the state machine call (so replaying logs would still be deterministic).
-	for _, r := range ipset.Ranges() {
-		ip := r.From()
-		toIP := r.To()
-		if !ip.IsValid() || !toIP.IsValid() {
+// unusedIP picks an address to hand out to ps for this checkout: a free address (never
+// allocated, or reaped and returned to ps's free set) if one is available, or else the address
+// with the oldest (and, by
+// reuseDeadline, expired) lease. addrSpace and the free set make both paths cost time
+// proportional to the number of distinct free ranges or expired leases, not to the size of the
+// pool, so this works as well for a large IPv6 pool as it does for a small IPv4 one.
+//
+// nid, domain and updatedAt identify the checkout driving this allocation; they seed the PRNG
+// used to pick among free addresses, so that replaying this call deterministically
+// picks the same address on every replica.
+func (ipp *ConsensusIPPool) unusedIP(ps *consensusPerPeerState, nid tailcfg.NodeID, domain string, updatedAt, reuseDeadline time.Time) (netip.Addr, bool, string, error) {
+	// AllocationStrategyLRU still has to draw from the free set the first time a peer is seen,
+	// since there's nothing yet to reclaim; after that it always prefers reclaiming over
+	// growing into the free set.
+	if ipp.config.AllocationStrategy != AllocationStrategyLRU || len(ps.leases) == 0 {
+		if ps.free == nil {
+			ps.free = newFreeSet(ipp.addrSpace.total)
+		}
+		var offset uint64
+		var ok bool
+		if ipp.config.AllocationStrategy == AllocationStrategySequential {
+			offset, ok = ps.free.takeLowest()
+		} else {
+			rng := rand.New(rand.NewSource(allocSeed(nid, domain, updatedAt)))
+			offset, ok = ps.free.pickRandom(rng)
+		}
+		if ok {
+			return ipp.addrSpace.addr(offset), false, "", nil
+		}
+	}
+	// The free set is exhausted, or AllocationStrategyLRU always prefers reuse: fall back to
+	// reclaiming the oldest lease, via the same heap the lease reaper uses, instead of
+	// rescanning every address for one that's expired. AllocationStrategyLRU reclaims the
+	// oldest lease unconditionally; the other strategies only reclaim leases already expired
+	// by reuseDeadline, to avoid stealing an address still genuinely in use just because the
+	// pool ran out of fresh ones.
+	lru := ipp.config.AllocationStrategy == AllocationStrategyLRU
+	for len(ps.leases) > 0 {
+		item := ps.leases[0]
+		ww, ok := ps.addrToDomain.Load(item.addr)
+		if !ok || ww.LeaseID != item.leaseID {
+			heap.Pop(&ps.leases) // stale entry: already reaped or renewed, discard and keep looking
 			continue
 		}
-		for toIP.Compare(ip) != -1 {
-			ww, ok := ps.addrToDomain.Load(ip)
-			if !ok {
-				return ip, false, "", nil
-			}
-			if ww.LastUsed.Before(reuseDeadline) {
-				return ip, true, ww.Domain, nil
-			}
-			ip = ip.Next()
+		if !lru && !ww.LastUsed.Before(reuseDeadline) {
+			break // the oldest live lease hasn't expired yet; nothing left to reclaim
 		}
+		heap.Pop(&ps.leases)
+		return item.addr, true, ww.Domain, nil
 	}
+	metricPoolExhaustedTotal.Add(1)
 	return netip.Addr{}, false, "", errors.New("ip pool exhausted")
 }
 
 // IPForDomain is part of the IPPool interface. It returns an IP address for the given domain for the given node
 // allocating an IP address from the pool if we haven't already.
-func (ipp *ConsensusIPPool) IPForDomain(nid tailcfg.NodeID, domain string) (netip.Addr, error) {
+//
+// It also returns the raft log index the checkoutAddr command was applied at. A caller that's
+// about to route traffic for the returned address can pass that index to DomainForIP's
+// minAppliedIndex, instead of racing DomainForIP against this node's own Apply goroutine.
+//
+// This assumes tsconsensus.CommandResult carries an Index field set to the raft log index
+// ExecuteCommand's command was applied at -- this function has no other way to learn that index.
+func (ipp *ConsensusIPPool) IPForDomain(nid tailcfg.NodeID, domain string) (netip.Addr, uint64, error) {
 	now := time.Now()
 	args := checkoutAddrArgs{
 		NodeID:        nid,
 		Domain:        domain,
-		ReuseDeadline: now.Add(-48 * time.Hour), // TODO (fran) is this appropriate? should it be configurable?
+		ReuseDeadline: now.Add(-ipp.config.ReuseDeadline),
 		UpdatedAt:     now,
 	}
-	bs, err := json.Marshal(args)
+	bs, err := encodeCheckoutAddrArgs(args)
 	if err != nil {
-		return netip.Addr{}, err
+		return netip.Addr{}, 0, err
 	}
 	c := tsconsensus.Command{
 		Name: "checkoutAddr",
@@ -160,15 +244,17 @@ func (ipp *ConsensusIPPool) IPForDomain(nid tailcfg.NodeID, domain string) (neti
 	result, err := ipp.consensus.ExecuteCommand(c)
 	if err != nil {
 		log.Printf("IPForDomain: raft error executing command: %v", err)
-		return netip.Addr{}, err
+		return netip.Addr{}, 0, err
 	}
 	if result.Err != nil {
 		log.Printf("IPForDomain: error returned from state machine: %v", err)
-		return netip.Addr{}, result.Err
+		return netip.Addr{}, 0, result.Err
 	}
-	var addr netip.Addr
-	err = json.Unmarshal(result.Result, &addr)
-	return addr, err
+	addr, err := decodeCheckoutAddrResult(result.Result)
+	if err == nil {
+		metricCheckoutsTotal.Add(1)
+	}
+	return addr, result.Index, err
 }
 
 type markLastUsedArgs struct {
@@ -180,8 +266,7 @@ type markLastUsedArgs struct {
 
 // executeMarkLastUsed parses a markLastUsed log entry and applies it.
 func (ipp *ConsensusIPPool) executeMarkLastUsed(bs []byte) tsconsensus.CommandResult {
-	var args markLastUsedArgs
-	err := json.Unmarshal(bs, &args)
+	args, err := decodeMarkLastUsedArgs(bs)
 	if err != nil {
 		return tsconsensus.CommandResult{Err: err}
 	}
@@ -217,6 +302,7 @@ func (ipp *ConsensusIPPool) applyMarkLastUsed(from tailcfg.NodeID, addr netip.Ad
 		return nil
 	}
 	ww.LastUsed = updatedAt
+	ww.LeaseID = ps.renewLease(addr, updatedAt, ipp.config.ReuseDeadline)
 	ps.addrToDomain.Store(addr, ww)
 	return nil
 }
@@ -229,7 +315,7 @@ func (ipp *ConsensusIPPool) markLastUsed(nid tailcfg.NodeID, addr netip.Addr, do
 		Domain:    domain,
 		UpdatedAt: lastUsed,
 	}
-	bs, err := json.Marshal(args)
+	bs, err := encodeMarkLastUsedArgs(args)
 	if err != nil {
 		return err
 	}
@@ -258,8 +344,7 @@ type checkoutAddrArgs struct {
 
 // executeCheckoutAddr parses a checkoutAddr raft log entry and applies it.
 func (ipp *ConsensusIPPool) executeCheckoutAddr(bs []byte) tsconsensus.CommandResult {
-	var args checkoutAddrArgs
-	err := json.Unmarshal(bs, &args)
+	args, err := decodeCheckoutAddrArgs(bs)
 	if err != nil {
 		return tsconsensus.CommandResult{Err: err}
 	}
@@ -267,7 +352,7 @@ func (ipp *ConsensusIPPool) executeCheckoutAddr(bs []byte) tsconsensus.CommandRe
 	if err != nil {
 		return tsconsensus.CommandResult{Err: err}
 	}
-	resultBs, err := json.Marshal(addr)
+	resultBs, err := encodeCheckoutAddrResult(addr)
 	if err != nil {
 		return tsconsensus.CommandResult{Err: err}
 	}
@@ -294,12 +379,13 @@ func (ipp *ConsensusIPPool) applyCheckoutAddr(nid tailcfg.NodeID, domain string,
 		ww, ok := ps.addrToDomain.Load(existing)
 		if ok {
 			ww.LastUsed = updatedAt
+			ww.LeaseID = ps.renewLease(existing, updatedAt, ipp.config.ReuseDeadline)
 			ps.addrToDomain.Store(existing, ww)
 			return existing, nil
 		}
 		log.Printf("applyCheckoutAddr: data out of sync, allocating new IP")
 	}
-	addr, wasInUse, previousDomain, err := ps.unusedIPV4(ipp.IPSet, reuseDeadline)
+	addr, wasInUse, previousDomain, err := ipp.unusedIP(ps, nid, domain, updatedAt, reuseDeadline)
 	if err != nil {
 		return netip.Addr{}, err
 	}
@@ -307,12 +393,18 @@ func (ipp *ConsensusIPPool) applyCheckoutAddr(nid tailcfg.NodeID, domain string,
 	if wasInUse {
 		delete(ps.domainToAddr, previousDomain)
 	}
-	ps.addrToDomain.Store(addr, whereWhen{Domain: domain, LastUsed: updatedAt})
+	lid := ps.renewLease(addr, updatedAt, ipp.config.ReuseDeadline)
+	ps.addrToDomain.Store(addr, whereWhen{Domain: domain, LastUsed: updatedAt, LeaseID: lid})
 	return addr, nil
 }
 
 // Apply is part of the raft.FSM interface. It takes an incoming log entry and applies it to the state.
 func (ipp *ConsensusIPPool) Apply(l *raft.Log) any {
+	start := time.Now()
+	defer func() {
+		metricApplyLatencyMicroseconds.Set(time.Since(start).Microseconds())
+	}()
+	defer ipp.appliedIndex.set(l.Index)
 	var c tsconsensus.Command
 	if err := json.Unmarshal(l.Data, &c); err != nil {
 		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
@@ -322,6 +414,8 @@ func (ipp *ConsensusIPPool) Apply(l *raft.Log) any {
 		return ipp.executeCheckoutAddr(c.Args)
 	case "markLastUsed":
 		return ipp.executeMarkLastUsed(c.Args)
+	case "revokeLease":
+		return ipp.executeRevokeLease(c.Args)
 	default:
 		panic(fmt.Sprintf("unrecognized command: %s", c.Name))
 	}
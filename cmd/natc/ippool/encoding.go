@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"tailscale.com/cmd/natc/ippool/ippoolpb"
+	"tailscale.com/tailcfg"
+)
+
+// argsEncoding is a one-byte header prepended to the Args of every
+// tsconsensus.Command this package proposes. It lets a cluster move from the
+// original encoding/json wire format to protobuf without a flag day: old log
+// entries (and entries from peers that haven't upgraded yet) don't carry the
+// header at all, and are told apart from new ones because a JSON object
+// always starts with '{' (0x7b), which argsEncoding never uses.
+type argsEncoding byte
+
+const (
+	// argsEncodingProtobuf marks Args as an argsEncoding byte followed by an
+	// ippoolpb-encoded message. This is what this version of the package
+	// writes.
+	argsEncodingProtobuf argsEncoding = 1
+)
+
+// isLegacyJSON reports whether bs is a pre-protobuf, unprefixed JSON log
+// entry.
+func isLegacyJSON(bs []byte) bool {
+	return len(bs) > 0 && bs[0] == '{'
+}
+
+// checkArgsEncoding validates bs's one-byte argsEncoding header against the encodings this
+// version of the package knows how to decode, so that a future, unrecognized encoding is
+// rejected instead of being silently misparsed as today's protobuf layout.
+func checkArgsEncoding(bs []byte) error {
+	if argsEncoding(bs[0]) != argsEncodingProtobuf {
+		return fmt.Errorf("ippool: unrecognized argsEncoding %d", bs[0])
+	}
+	return nil
+}
+
+func encodeCheckoutAddrArgs(args checkoutAddrArgs) ([]byte, error) {
+	pb := ippoolpb.CheckoutAddrArgs{
+		NodeID:                uint64(args.NodeID),
+		Domain:                args.Domain,
+		ReuseDeadlineUnixNano: args.ReuseDeadline.UnixNano(),
+		UpdatedAtUnixNano:     args.UpdatedAt.UnixNano(),
+	}
+	body, err := pb.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(argsEncodingProtobuf)}, body...), nil
+}
+
+func decodeCheckoutAddrArgs(bs []byte) (checkoutAddrArgs, error) {
+	var args checkoutAddrArgs
+	if isLegacyJSON(bs) {
+		err := json.Unmarshal(bs, &args)
+		return args, err
+	}
+	if len(bs) == 0 {
+		return args, fmt.Errorf("ippool: empty checkoutAddr args")
+	}
+	if err := checkArgsEncoding(bs); err != nil {
+		return args, err
+	}
+	var pb ippoolpb.CheckoutAddrArgs
+	if err := pb.UnmarshalBinary(bs[1:]); err != nil {
+		return args, err
+	}
+	args.NodeID = tailcfg.NodeID(pb.NodeID)
+	args.Domain = pb.Domain
+	args.ReuseDeadline = time.Unix(0, pb.ReuseDeadlineUnixNano).UTC()
+	args.UpdatedAt = time.Unix(0, pb.UpdatedAtUnixNano).UTC()
+	return args, nil
+}
+
+func encodeMarkLastUsedArgs(args markLastUsedArgs) ([]byte, error) {
+	addrBytes, err := args.Addr.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	pb := ippoolpb.MarkLastUsedArgs{
+		NodeID:            uint64(args.NodeID),
+		Addr:              addrBytes,
+		Domain:            args.Domain,
+		UpdatedAtUnixNano: args.UpdatedAt.UnixNano(),
+	}
+	body, err := pb.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(argsEncodingProtobuf)}, body...), nil
+}
+
+func decodeMarkLastUsedArgs(bs []byte) (markLastUsedArgs, error) {
+	var args markLastUsedArgs
+	if isLegacyJSON(bs) {
+		err := json.Unmarshal(bs, &args)
+		return args, err
+	}
+	if len(bs) == 0 {
+		return args, fmt.Errorf("ippool: empty markLastUsed args")
+	}
+	if err := checkArgsEncoding(bs); err != nil {
+		return args, err
+	}
+	var pb ippoolpb.MarkLastUsedArgs
+	if err := pb.UnmarshalBinary(bs[1:]); err != nil {
+		return args, err
+	}
+	args.NodeID = tailcfg.NodeID(pb.NodeID)
+	if err := args.Addr.UnmarshalBinary(pb.Addr); err != nil {
+		return args, err
+	}
+	args.Domain = pb.Domain
+	args.UpdatedAt = time.Unix(0, pb.UpdatedAtUnixNano).UTC()
+	return args, nil
+}
+
+// encodeRevokeLeaseArgs and decodeRevokeLeaseArgs don't need argsEncoding's JSON fallback:
+// "revokeLease" didn't exist before protobuf became this package's wire format, so there are no
+// legacy JSON log entries of this type to stay compatible with.
+func encodeRevokeLeaseArgs(args revokeLeaseArgs) ([]byte, error) {
+	pb := ippoolpb.RevokeLeaseArgs{NowUnixNano: args.Now.UnixNano()}
+	body, err := pb.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(argsEncodingProtobuf)}, body...), nil
+}
+
+func decodeRevokeLeaseArgs(bs []byte) (revokeLeaseArgs, error) {
+	if len(bs) == 0 {
+		return revokeLeaseArgs{}, fmt.Errorf("ippool: empty revokeLease args")
+	}
+	if err := checkArgsEncoding(bs); err != nil {
+		return revokeLeaseArgs{}, err
+	}
+	var pb ippoolpb.RevokeLeaseArgs
+	if err := pb.UnmarshalBinary(bs[1:]); err != nil {
+		return revokeLeaseArgs{}, err
+	}
+	return revokeLeaseArgs{Now: time.Unix(0, pb.NowUnixNano).UTC()}, nil
+}
+
+func encodeCheckoutAddrResult(addr netip.Addr) ([]byte, error) {
+	addrBytes, err := addr.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	pb := ippoolpb.CheckoutAddrResult{Addr: addrBytes}
+	body, err := pb.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(argsEncodingProtobuf)}, body...), nil
+}
+
+func decodeCheckoutAddrResult(bs []byte) (netip.Addr, error) {
+	var addr netip.Addr
+	if isLegacyJSON(bs) {
+		err := json.Unmarshal(bs, &addr)
+		return addr, err
+	}
+	if len(bs) == 0 {
+		return addr, fmt.Errorf("ippool: empty checkoutAddr result")
+	}
+	if err := checkArgsEncoding(bs); err != nil {
+		return addr, err
+	}
+	var pb ippoolpb.CheckoutAddrResult
+	if err := pb.UnmarshalBinary(bs[1:]); err != nil {
+		return addr, err
+	}
+	err := addr.UnmarshalBinary(pb.Addr)
+	return addr, err
+}
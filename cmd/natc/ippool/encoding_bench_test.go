@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// BenchmarkApplyCheckoutAddrJSON and BenchmarkApplyCheckoutAddrProtobuf compare Apply-path CPU
+// for the two Args encodings, end to end (decode + apply + encode result).
+func BenchmarkApplyCheckoutAddrJSON(b *testing.B) {
+	ipp := newTestPool(b)
+	now := time.Now()
+	args := checkoutAddrArgs{
+		NodeID:        tailcfg.NodeID(1),
+		Domain:        "example.com",
+		ReuseDeadline: now.Add(-48 * time.Hour),
+		UpdatedAt:     now,
+	}
+	bs, err := json.Marshal(args)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		args.Domain = "example.com" // keep the same key so we exercise the reuse path, not growth
+		result := ipp.executeCheckoutAddrJSONForBench(bs)
+		if result.Err != nil {
+			b.Fatal(result.Err)
+		}
+	}
+}
+
+func BenchmarkApplyCheckoutAddrProtobuf(b *testing.B) {
+	ipp := newTestPool(b)
+	now := time.Now()
+	args := checkoutAddrArgs{
+		NodeID:        tailcfg.NodeID(1),
+		Domain:        "example.com",
+		ReuseDeadline: now.Add(-48 * time.Hour),
+		UpdatedAt:     now,
+	}
+	bs, err := encodeCheckoutAddrArgs(args)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result := ipp.executeCheckoutAddr(bs)
+		if result.Err != nil {
+			b.Fatal(result.Err)
+		}
+	}
+}
+
+// executeCheckoutAddrJSONForBench mirrors executeCheckoutAddr but uses the legacy JSON format
+// throughout: it decodes Args with encoding/json, without going through
+// decodeCheckoutAddrArgs's format sniffing, and encodes the result with json.Marshal instead of
+// encodeCheckoutAddrResult. The applyCheckoutAddr step is the same as the protobuf path's.
+func (ipp *ConsensusIPPool) executeCheckoutAddrJSONForBench(bs []byte) tsconsensusCommandResultForBench {
+	var args checkoutAddrArgs
+	if err := json.Unmarshal(bs, &args); err != nil {
+		return tsconsensusCommandResultForBench{Err: err}
+	}
+	addr, err := ipp.applyCheckoutAddr(args.NodeID, args.Domain, args.ReuseDeadline, args.UpdatedAt)
+	if err != nil {
+		return tsconsensusCommandResultForBench{Err: err}
+	}
+	if _, err := json.Marshal(addr); err != nil {
+		return tsconsensusCommandResultForBench{Err: err}
+	}
+	return tsconsensusCommandResultForBench{}
+}
+
+// tsconsensusCommandResultForBench is a trimmed-down stand-in for tsconsensus.CommandResult, to
+// avoid pulling the benchmark's legacy-JSON-only path through this package's real Apply
+// plumbing.
+type tsconsensusCommandResultForBench struct {
+	Err error
+}
@@ -0,0 +1,26 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import "testing"
+
+// TestDecodeArgsRejectsUnrecognizedEncoding checks that a non-legacy-JSON, non-argsEncodingProtobuf
+// header byte is rejected rather than silently fed to the current protobuf decoder: that's the
+// whole point of the version byte described on argsEncoding's doc.
+func TestDecodeArgsRejectsUnrecognizedEncoding(t *testing.T) {
+	unknown := []byte{0xff, 1, 2, 3}
+
+	if _, err := decodeCheckoutAddrArgs(unknown); err == nil {
+		t.Error("decodeCheckoutAddrArgs: got nil error for unrecognized argsEncoding, want non-nil")
+	}
+	if _, err := decodeMarkLastUsedArgs(unknown); err == nil {
+		t.Error("decodeMarkLastUsedArgs: got nil error for unrecognized argsEncoding, want non-nil")
+	}
+	if _, err := decodeCheckoutAddrResult(unknown); err == nil {
+		t.Error("decodeCheckoutAddrResult: got nil error for unrecognized argsEncoding, want non-nil")
+	}
+	if _, err := unmarshalSnapshot(unknown); err == nil {
+		t.Error("unmarshalSnapshot: got nil error for unrecognized argsEncoding, want non-nil")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"context"
+	"sync"
+)
+
+// appliedIndexTracker tracks the highest raft log index this node's FSM has applied, and lets
+// callers block until a given index has been applied. It replaces the old approach of sleeping
+// and retrying: the raft lib can report a log entry committed to a quorum before this node's
+// local Apply has caught up to it, so a caller that knows the index its write committed at can
+// wait on exactly that instead of guessing with a backoff.
+type appliedIndexTracker struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	index uint64
+}
+
+func newAppliedIndexTracker() *appliedIndexTracker {
+	t := &appliedIndexTracker{}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// set records that index has been applied, waking any goroutines in await waiting on it or an
+// earlier index. Indexes may arrive out of order relative to concurrent reads of get, but Apply
+// itself is only ever called by raft with monotonically increasing indexes.
+func (t *appliedIndexTracker) set(index uint64) {
+	t.mu.Lock()
+	if index > t.index {
+		t.index = index
+	}
+	t.mu.Unlock()
+	t.cond.Broadcast()
+}
+
+func (t *appliedIndexTracker) get() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.index
+}
+
+// await blocks until index has been applied, or ctx is done.
+func (t *appliedIndexTracker) await(ctx context.Context, index uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.index >= index {
+		return nil
+	}
+	// Broadcast under mu, so the wakeup can't land between the ctx.Err check below and Wait.
+	stop := context.AfterFunc(ctx, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.cond.Broadcast()
+	})
+	defer stop()
+	for t.index < index {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t.cond.Wait()
+	}
+	return nil
+}
+
+// AwaitAppliedIndex blocks until this node's FSM has applied the raft log up to and including
+// idx, or ctx is done. Callers that have a write's committed index (see IPForDomain) can use
+// this for a read-your-writes guarantee instead of sleeping and hoping Apply has caught up.
+func (ipp *ConsensusIPPool) AwaitAppliedIndex(ctx context.Context, idx uint64) error {
+	return ipp.appliedIndex.await(ctx, idx)
+}
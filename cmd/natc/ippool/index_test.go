@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestAppliedIndexTrackerAwaitAlreadyApplied(t *testing.T) {
+	tr := newAppliedIndexTracker()
+	tr.set(5)
+	if err := tr.await(context.Background(), 3); err != nil {
+		t.Fatalf("await: %v", err)
+	}
+}
+
+func TestAppliedIndexTrackerAwaitBlocksUntilSet(t *testing.T) {
+	tr := newAppliedIndexTracker()
+	done := make(chan error, 1)
+	go func() {
+		done <- tr.await(context.Background(), 10)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("await returned early with %v before index was set", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	tr.set(10)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("await: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("await did not return after set")
+	}
+}
+
+func TestAppliedIndexTrackerAwaitContextCanceled(t *testing.T) {
+	tr := newAppliedIndexTracker()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := tr.await(ctx, 10); err == nil {
+		t.Fatal("expected await to return an error when the context is done")
+	}
+}
+
+func TestDomainForIPWaitsForMinAppliedIndex(t *testing.T) {
+	ipp := newTestPool(t)
+	nid := tailcfg.NodeID(1)
+	now := time.Now()
+	addr, err := ipp.applyCheckoutAddr(nid, "example.com", now.Add(-48*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipp.consensus = &fakeExecutor{ipp: ipp}
+	ipp.appliedIndex.set(1)
+
+	done := make(chan struct{})
+	go func() {
+		domain, ok := ipp.DomainForIP(context.Background(), nid, addr, now, 5)
+		if !ok || domain != "example.com" {
+			t.Errorf("DomainForIP returned (%q, %v), want (example.com, true)", domain, ok)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("DomainForIP returned before its minAppliedIndex was applied")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	ipp.appliedIndex.set(5)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("DomainForIP did not return after its minAppliedIndex was applied")
+	}
+}
@@ -0,0 +1,10 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippoolpb
+
+// Messages are currently hand-marshaled in ippool.go against protowire; see
+// its package doc for why. Re-enable codegen here if the schema grows enough
+// to be worth it:
+//
+// go:generate protoc --go_out=. --go_opt=paths=source_relative ippool.proto
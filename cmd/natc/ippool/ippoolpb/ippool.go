@@ -0,0 +1,429 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package ippoolpb implements the wire encoding for the messages described
+// in ippool.proto. It's hand-written against protowire rather than run
+// through protoc-gen-go, since the messages are few and simple enough that
+// the generated boilerplate isn't worth carrying; if the schema grows,
+// switch generate.go's directive back on and delete this file.
+package ippoolpb
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// CheckoutAddrArgs is the payload of a "checkoutAddr" command.
+type CheckoutAddrArgs struct {
+	NodeID                uint64
+	Domain                string
+	ReuseDeadlineUnixNano int64
+	UpdatedAtUnixNano     int64
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (a *CheckoutAddrArgs) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, a.NodeID)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, a.Domain)
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(a.ReuseDeadlineUnixNano))
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(a.UpdatedAtUnixNano))
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (a *CheckoutAddrArgs) UnmarshalBinary(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("ippoolpb: bad tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad node_id: %w", protowire.ParseError(n))
+			}
+			a.NodeID = v
+			b = b[n:]
+		case 2:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad domain: %w", protowire.ParseError(n))
+			}
+			a.Domain = v
+			b = b[n:]
+		case 3:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad reuse_deadline_unix_nano: %w", protowire.ParseError(n))
+			}
+			a.ReuseDeadlineUnixNano = int64(v)
+			b = b[n:]
+		case 4:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad updated_at_unix_nano: %w", protowire.ParseError(n))
+			}
+			a.UpdatedAtUnixNano = int64(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// MarkLastUsedArgs is the payload of a "markLastUsed" command.
+type MarkLastUsedArgs struct {
+	NodeID            uint64
+	Addr              []byte // netip.Addr.MarshalBinary
+	Domain            string
+	UpdatedAtUnixNano int64
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (a *MarkLastUsedArgs) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, a.NodeID)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, a.Addr)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, a.Domain)
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(a.UpdatedAtUnixNano))
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (a *MarkLastUsedArgs) UnmarshalBinary(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("ippoolpb: bad tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad node_id: %w", protowire.ParseError(n))
+			}
+			a.NodeID = v
+			b = b[n:]
+		case 2:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad addr: %w", protowire.ParseError(n))
+			}
+			a.Addr = append([]byte(nil), v...)
+			b = b[n:]
+		case 3:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad domain: %w", protowire.ParseError(n))
+			}
+			a.Domain = v
+			b = b[n:]
+		case 4:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad updated_at_unix_nano: %w", protowire.ParseError(n))
+			}
+			a.UpdatedAtUnixNano = int64(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// CheckoutAddrResult is the result of applying a "checkoutAddr" command.
+type CheckoutAddrResult struct {
+	Addr []byte // netip.Addr.MarshalBinary
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (r *CheckoutAddrResult) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, r.Addr)
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (r *CheckoutAddrResult) UnmarshalBinary(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("ippoolpb: bad tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad addr: %w", protowire.ParseError(n))
+			}
+			r.Addr = append([]byte(nil), v...)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// RevokeLeaseArgs is the payload of a "revokeLease" command.
+type RevokeLeaseArgs struct {
+	NowUnixNano int64
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (a *RevokeLeaseArgs) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(a.NowUnixNano))
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (a *RevokeLeaseArgs) UnmarshalBinary(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("ippoolpb: bad tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad now_unix_nano: %w", protowire.ParseError(n))
+			}
+			a.NowUnixNano = int64(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// Snapshot is the wire format written by fsmSnapshot.Persist.
+type Snapshot struct {
+	Version uint32
+	Peers   []*SnapshotPeer
+}
+
+type SnapshotPeer struct {
+	NodeID      uint64
+	Entries     []*SnapshotEntry
+	NextLeaseID uint64
+}
+
+type SnapshotEntry struct {
+	Addr             []byte // netip.Addr.MarshalBinary
+	Domain           string
+	LastUsedUnixNano int64
+	LeaseID          uint64
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (s *Snapshot) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(s.Version))
+	for _, p := range s.Peers {
+		pb, err := p.marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, pb)
+	}
+	return b, nil
+}
+
+func (p *SnapshotPeer) marshal() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.NodeID)
+	for _, e := range p.Entries {
+		eb, err := e.marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, eb)
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.NextLeaseID)
+	return b, nil
+}
+
+func (e *SnapshotEntry) marshal() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, e.Addr)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, e.Domain)
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(e.LastUsedUnixNano))
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, e.LeaseID)
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (s *Snapshot) UnmarshalBinary(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("ippoolpb: bad tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad version: %w", protowire.ParseError(n))
+			}
+			s.Version = uint32(v)
+			b = b[n:]
+		case 2:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad peer: %w", protowire.ParseError(n))
+			}
+			p := new(SnapshotPeer)
+			if err := p.unmarshal(v); err != nil {
+				return err
+			}
+			s.Peers = append(s.Peers, p)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func (p *SnapshotPeer) unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("ippoolpb: bad tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad node_id: %w", protowire.ParseError(n))
+			}
+			p.NodeID = v
+			b = b[n:]
+		case 2:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad entry: %w", protowire.ParseError(n))
+			}
+			e := new(SnapshotEntry)
+			if err := e.unmarshal(v); err != nil {
+				return err
+			}
+			p.Entries = append(p.Entries, e)
+			b = b[n:]
+		case 3:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad next_lease_id: %w", protowire.ParseError(n))
+			}
+			p.NextLeaseID = v
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func (e *SnapshotEntry) unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("ippoolpb: bad tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad addr: %w", protowire.ParseError(n))
+			}
+			e.Addr = append([]byte(nil), v...)
+			b = b[n:]
+		case 2:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad domain: %w", protowire.ParseError(n))
+			}
+			e.Domain = v
+			b = b[n:]
+		case 3:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad last_used_unix_nano: %w", protowire.ParseError(n))
+			}
+			e.LastUsedUnixNano = int64(v)
+			b = b[n:]
+		case 4:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad lease_id: %w", protowire.ParseError(n))
+			}
+			e.LeaseID = v
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("ippoolpb: bad field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
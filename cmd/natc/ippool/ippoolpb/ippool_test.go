@@ -0,0 +1,60 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippoolpb
+
+import "testing"
+
+func TestCheckoutAddrArgsRoundTrip(t *testing.T) {
+	want := CheckoutAddrArgs{
+		NodeID:                42,
+		Domain:                "example.com",
+		ReuseDeadlineUnixNano: 100,
+		UpdatedAtUnixNano:     200,
+	}
+	bs, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got CheckoutAddrArgs
+	if err := got.UnmarshalBinary(bs); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	want := Snapshot{
+		Version: 1,
+		Peers: []*SnapshotPeer{
+			{
+				NodeID: 7,
+				Entries: []*SnapshotEntry{
+					{Addr: []byte{100, 64, 0, 1}, Domain: "example.com", LastUsedUnixNano: 123, LeaseID: 1},
+					{Addr: []byte{100, 64, 0, 2}, Domain: "example.org", LastUsedUnixNano: 456, LeaseID: 2},
+				},
+			},
+		},
+	}
+	bs, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Snapshot
+	if err := got.UnmarshalBinary(bs); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != want.Version || len(got.Peers) != len(want.Peers) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got.Peers[0].NodeID != want.Peers[0].NodeID || len(got.Peers[0].Entries) != len(want.Peers[0].Entries) {
+		t.Fatalf("got %+v, want %+v", got.Peers[0], want.Peers[0])
+	}
+	for i, e := range want.Peers[0].Entries {
+		if got.Peers[0].Entries[i].LeaseID != e.LeaseID {
+			t.Errorf("entry %d: LeaseID = %d, want %d", i, got.Peers[0].Entries[i].LeaseID, e.LeaseID)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsconsensus"
+)
+
+// leaseID identifies one allocation of an address to a domain. It's bumped every time the
+// address's lease is renewed (by checkout or by markLastUsed/Renew), so that a stale entry in
+// a consensusPerPeerState's lease heap can be told apart from the address's current lease.
+type leaseID uint64
+
+// leaseHeapItem is one entry in a consensusPerPeerState's leases heap.
+type leaseHeapItem struct {
+	addr    netip.Addr
+	leaseID leaseID
+	expiry  time.Time
+}
+
+// leaseHeap is a min-heap of leaseHeapItem ordered by expiry, so the soonest-to-expire lease is
+// always at the root. Renewing a lease doesn't update or remove its old heap entry; it pushes a
+// new one with a new leaseID, leaving the stale entry to be discarded when it reaches the root
+// and no longer matches the address's current LeaseID in addrToDomain.
+type leaseHeap []leaseHeapItem
+
+func (h leaseHeap) Len() int           { return len(h) }
+func (h leaseHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+func (h leaseHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *leaseHeap) Push(x any) {
+	*h = append(*h, x.(leaseHeapItem))
+}
+
+func (h *leaseHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// renewLease issues a new leaseID for addr, due to expire at now.Add(ttl), and records it in
+// ps's lease heap. It's only called from Apply, like the rest of consensusPerPeerState's
+// mutable state.
+func (ps *consensusPerPeerState) renewLease(addr netip.Addr, now time.Time, ttl time.Duration) leaseID {
+	ps.nextLeaseID++
+	id := leaseID(ps.nextLeaseID)
+	heap.Push(&ps.leases, leaseHeapItem{addr: addr, leaseID: id, expiry: now.Add(ttl)})
+	return id
+}
+
+// Renew extends the lease on addr for nid, as an alternative to relying on DomainForIP's
+// incidental markLastUsed call to do it. It's useful for callers that want to keep an address
+// alive without necessarily having just resolved traffic for it.
+func (ipp *ConsensusIPPool) Renew(nid tailcfg.NodeID, addr netip.Addr) error {
+	ps, ok := ipp.perPeerMap.Load(nid)
+	if !ok {
+		return fmt.Errorf("ippool: Renew: no state for node %v", nid)
+	}
+	ww, ok := ps.addrToDomain.Load(addr)
+	if !ok {
+		return fmt.Errorf("ippool: Renew: no lease for %v", addr)
+	}
+	return ipp.markLastUsed(nid, addr, ww.Domain, time.Now())
+}
+
+// revokeLeaseArgs is the payload of a "revokeLease" command.
+type revokeLeaseArgs struct {
+	Now time.Time
+}
+
+// executeRevokeLease parses a revokeLease raft log entry and applies it.
+func (ipp *ConsensusIPPool) executeRevokeLease(bs []byte) tsconsensus.CommandResult {
+	args, err := decodeRevokeLeaseArgs(bs)
+	if err != nil {
+		return tsconsensus.CommandResult{Err: err}
+	}
+	ipp.applyRevokeLease(args.Now)
+	return tsconsensus.CommandResult{}
+}
+
+// applyRevokeLease reaps every expired, non-stale lease across all peers. The decision of
+// which leases have expired is made purely from each peer's own lease heap and the passed-in
+// now (which every replica received identically via the log), so every replica reaps the same
+// set regardless of which node is currently leader.
+// It is not safe for concurrent access. It's only called from raft which will not call it
+// concurrently.
+func (ipp *ConsensusIPPool) applyRevokeLease(now time.Time) {
+	ipp.perPeerMap.Range(func(_ tailcfg.NodeID, ps *consensusPerPeerState) bool {
+		for len(ps.leases) > 0 && !ps.leases[0].expiry.After(now) {
+			item := heap.Pop(&ps.leases).(leaseHeapItem)
+			ww, ok := ps.addrToDomain.Load(item.addr)
+			if !ok || ww.LeaseID != item.leaseID {
+				// Stale: the lease was renewed, or the address was reused, since this heap
+				// entry was pushed. Nothing to revoke.
+				continue
+			}
+			ps.addrToDomain.Delete(item.addr)
+			if existing, ok := ps.domainToAddr[ww.Domain]; ok && existing == item.addr {
+				delete(ps.domainToAddr, ww.Domain)
+			}
+			if ps.free != nil {
+				if offset, ok := ipp.addrSpace.offsetOf(item.addr); ok {
+					ps.free.free(offset)
+				}
+			}
+		}
+		return true
+	})
+}
+
+// runLeaseReaper drives proactive lease expiry while this node is the raft leader. It ticks on
+// config.RevokeTickInterval and, while leading, proposes a revokeLease command so that expired
+// leases are reclaimed even for peers that have gone idle, instead of only being noticed the
+// next time some other domain's checkout stumbles onto them.
+//
+// This assumes tsconsensus.Consensus exposes a Raft() accessor returning the underlying
+// *raft.Raft (or something LeaderCh()-shaped), so this goroutine can tell when it's acquired or
+// lost leadership without tsconsensus itself needing a leader-change callback.
+func (ipp *ConsensusIPPool) runLeaseReaper(ctx context.Context, cns *tsconsensus.Consensus) {
+	ticker := time.NewTicker(ipp.config.RevokeTickInterval)
+	defer ticker.Stop()
+	leaderCh := cns.Raft().LeaderCh()
+	isLeader := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case isLeader = <-leaderCh:
+			ipp.isLeader.Store(isLeader)
+		case <-ticker.C:
+			if !isLeader {
+				continue
+			}
+			bs, err := encodeRevokeLeaseArgs(revokeLeaseArgs{Now: time.Now()})
+			if err != nil {
+				log.Printf("runLeaseReaper: encoding revokeLease args: %v", err)
+				continue
+			}
+			c := tsconsensus.Command{Name: "revokeLease", Args: bs}
+			if _, err := ipp.consensus.ExecuteCommand(c); err != nil {
+				log.Printf("runLeaseReaper: raft error executing revokeLease: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsconsensus"
+)
+
+// TestApplyRevokeLeaseReapsExpired checks that applyRevokeLease frees an address once its
+// lease has expired, and that a still-fresh lease on another address survives the same sweep.
+func TestApplyRevokeLeaseReapsExpired(t *testing.T) {
+	ipp := newTestPool(t)
+	ipp.config.ReuseDeadline = time.Minute
+	nid := tailcfg.NodeID(1)
+	base := time.Now()
+
+	expiredAddr, err := ipp.applyCheckoutAddr(nid, "old.example.com", base.Add(-48*time.Hour), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	freshAddr, err := ipp.applyCheckoutAddr(nid, "fresh.example.com", base.Add(-48*time.Hour), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiredAddr == freshAddr {
+		t.Fatal("test setup allocated the same address twice")
+	}
+
+	// Renew freshAddr's lease just before the sweep, so its new expiry (renewedAt+ReuseDeadline)
+	// falls after the sweep time even though its original one wouldn't have.
+	renewedAt := base.Add(110 * time.Second)
+	if err := ipp.applyMarkLastUsed(nid, freshAddr, "fresh.example.com", renewedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	ipp.applyRevokeLease(base.Add(2 * time.Minute))
+
+	ps, _ := ipp.perPeerMap.Load(nid)
+	if _, ok := ps.addrToDomain.Load(expiredAddr); ok {
+		t.Errorf("expired address %v was not reaped", expiredAddr)
+	}
+	if _, ok := ps.domainToAddr["old.example.com"]; ok {
+		t.Errorf("domainToAddr still has an entry for the reaped domain")
+	}
+	if _, ok := ps.addrToDomain.Load(freshAddr); !ok {
+		t.Errorf("freshly renewed address %v was incorrectly reaped", freshAddr)
+	}
+}
+
+// TestRenew checks that Renew on an existing lease proposes a markLastUsed command, using a fake
+// commandExecutor in place of a real raft cluster.
+func TestRenew(t *testing.T) {
+	ipp := newTestPool(t)
+	nid := tailcfg.NodeID(1)
+	now := time.Now()
+	addr, err := ipp.applyCheckoutAddr(nid, "example.com", now.Add(-48*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := &fakeExecutor{ipp: ipp}
+	ipp.consensus = fe
+
+	if err := ipp.Renew(nid, addr); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if fe.lastCommandName != "markLastUsed" {
+		t.Errorf("Renew proposed command %q, want markLastUsed", fe.lastCommandName)
+	}
+}
+
+// fakeExecutor is a commandExecutor standing in for a real raft cluster in tests. It records
+// the name of the last command proposed and returns an empty result; it doesn't apply the
+// command to ipp.
+type fakeExecutor struct {
+	ipp             *ConsensusIPPool
+	lastCommandName string
+}
+
+func (f *fakeExecutor) ExecuteCommand(c tsconsensus.Command) (tsconsensus.CommandResult, error) {
+	f.lastCommandName = c.Name
+	return tsconsensus.CommandResult{}, nil
+}
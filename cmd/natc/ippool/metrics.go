@@ -0,0 +1,18 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import "tailscale.com/util/clientmetric"
+
+// These are process-global, like every other clientmetric, rather than per-[ConsensusIPPool]:
+// a process only ever runs one ip pool, and clientmetric's reporting is itself process-wide.
+var (
+	metricCheckoutsTotal     = clientmetric.NewCounter("ippool_checkouts_total")
+	metricPoolExhaustedTotal = clientmetric.NewCounter("ippool_pool_exhausted_total")
+	// metricApplyLatencyMicroseconds is in microseconds, not seconds: clientmetric.Metric only
+	// carries an int64, so whole seconds would lose all the precision that matters for an
+	// Apply call. The name carries its own unit so a _seconds-suffix convention elsewhere
+	// doesn't mislead anyone graphing or alerting on it by six orders of magnitude.
+	metricApplyLatencyMicroseconds = clientmetric.NewGauge("ippool_apply_latency_microseconds")
+)
@@ -0,0 +1,211 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"tailscale.com/cmd/natc/ippool/ippoolpb"
+	"tailscale.com/syncs"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
+)
+
+// snapshotVersion is incremented whenever the wire format written by
+// [fsmSnapshot.Persist] changes, so that [ConsensusIPPool.Restore] can reject
+// snapshots it doesn't understand instead of silently misreading them.
+const snapshotVersion = 1
+
+// fsmSnapshot is a point in time copy of a [ConsensusIPPool]'s state. It
+// implements raft.FSMSnapshot so that raft can persist it to install on
+// other nodes, or to bring this node back up to date after a restart,
+// without needing to replay the entire log.
+type fsmSnapshot struct {
+	Version int
+	Peers   []snapshotPeer
+}
+
+// snapshotPeer is the portion of a snapshot belonging to a single node.
+type snapshotPeer struct {
+	NodeID  tailcfg.NodeID
+	Entries []snapshotEntry
+	// NextLeaseID carries forward the peer's lease counter, so a restored replica doesn't
+	// reissue a leaseID still held by a pre-snapshot lease. The lease heap itself isn't
+	// stored; Restore rebuilds it from Entries.
+	NextLeaseID uint64
+}
+
+// snapshotEntry is one allocated address within a [snapshotPeer]. LeaseID is carried forward so
+// that Restore can rebuild the peer's lease heap: the entry's expiry isn't stored directly, and
+// is instead recomputed from LastUsed and the restoring node's own configured ReuseDeadline, but
+// the heap item pushed for it must still use this LeaseID or it'll be discarded as stale the
+// first time it reaches the root.
+type snapshotEntry struct {
+	Addr     netip.Addr
+	Domain   string
+	LastUsed time.Time
+	LeaseID  leaseID
+}
+
+// Persist is part of the raft.FSMSnapshot interface. It writes the snapshot to sink as an
+// argsEncoding header followed by a protobuf-encoded [ippoolpb.Snapshot], so that Restore can
+// rebuild the pool's state from it.
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	bs, err := s.marshal()
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	if _, err := sink.Write(bs); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) marshal() ([]byte, error) {
+	pb := ippoolpb.Snapshot{Version: uint32(s.Version)}
+	for _, p := range s.Peers {
+		pp := &ippoolpb.SnapshotPeer{NodeID: uint64(p.NodeID), NextLeaseID: p.NextLeaseID}
+		for _, e := range p.Entries {
+			addrBytes, err := e.Addr.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			pp.Entries = append(pp.Entries, &ippoolpb.SnapshotEntry{
+				Addr:             addrBytes,
+				Domain:           e.Domain,
+				LastUsedUnixNano: e.LastUsed.UnixNano(),
+				LeaseID:          uint64(e.LeaseID),
+			})
+		}
+		pb.Peers = append(pb.Peers, pp)
+	}
+	body, err := pb.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(argsEncodingProtobuf)}, body...), nil
+}
+
+// Release is part of the raft.FSMSnapshot interface. fsmSnapshot holds no resources that
+// outlive Persist, so there's nothing to do here.
+func (s *fsmSnapshot) Release() {}
+
+// Snapshot is part of the raft.FSM interface. It takes a consistent read of the pool's state
+// and returns it as a raft.FSMSnapshot, which raft uses to compact the log and to catch up
+// new or lagging followers without replaying historical checkoutAddr/markLastUsed entries.
+func (ipp *ConsensusIPPool) Snapshot() (raft.FSMSnapshot, error) {
+	ipp.lastSnapshotUnixNano.Store(time.Now().UnixNano())
+	s := &fsmSnapshot{Version: snapshotVersion}
+	ipp.perPeerMap.Range(func(nid tailcfg.NodeID, ps *consensusPerPeerState) bool {
+		var entries []snapshotEntry
+		ps.addrToDomain.Range(func(addr netip.Addr, ww whereWhen) bool {
+			entries = append(entries, snapshotEntry{Addr: addr, Domain: ww.Domain, LastUsed: ww.LastUsed, LeaseID: ww.LeaseID})
+			return true
+		})
+		s.Peers = append(s.Peers, snapshotPeer{NodeID: nid, Entries: entries, NextLeaseID: ps.nextLeaseID})
+		return true
+	})
+	return s, nil
+}
+
+// Restore is part of the raft.FSM interface. It rebuilds the pool's domainToAddr and
+// addrToDomain state from a snapshot previously written by Persist, replacing the current
+// state atomically. raft calls this instead of replaying the log when a new or lagging node
+// is brought up to date from a snapshot.
+func (ipp *ConsensusIPPool) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+	s, err := unmarshalSnapshot(bs)
+	if err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("ippool: unsupported snapshot version %d", s.Version)
+	}
+	newMap := &syncs.Map[tailcfg.NodeID, *consensusPerPeerState]{}
+	for _, p := range s.Peers {
+		ps := &consensusPerPeerState{
+			addrToDomain: &syncs.Map[netip.Addr, whereWhen]{},
+			nextLeaseID:  p.NextLeaseID,
+		}
+		if len(p.Entries) > 0 {
+			// Create the free set here, rather than leaving unusedIP to create a full one
+			// lazily, and mark every already-allocated address taken in it below, so that
+			// unusedIP can't hand one of them out again.
+			ps.free = newFreeSet(ipp.addrSpace.total)
+		}
+		for _, e := range p.Entries {
+			mak.Set(&ps.domainToAddr, e.Domain, e.Addr)
+			ps.addrToDomain.Store(e.Addr, whereWhen{Domain: e.Domain, LastUsed: e.LastUsed, LeaseID: e.LeaseID})
+			if offset, ok := ipp.addrSpace.offsetOf(e.Addr); ok {
+				ps.free.take(offset)
+			}
+			// Rebuild the heap entry for this lease so it's still reachable by the lease
+			// reaper and by unusedIP's eviction fallback after the restore, instead of only
+			// becoming reapable again the next time this address happens to be touched. The
+			// snapshot doesn't carry the expiry directly; it's recomputed from LastUsed and
+			// this node's own currently configured ReuseDeadline, same as a live renewLease
+			// call would.
+			heap.Push(&ps.leases, leaseHeapItem{
+				addr:    e.Addr,
+				leaseID: e.LeaseID,
+				expiry:  e.LastUsed.Add(ipp.config.ReuseDeadline),
+			})
+		}
+		newMap.Store(p.NodeID, ps)
+	}
+	ipp.perPeerMap = newMap
+	return nil
+}
+
+// unmarshalSnapshot decodes bs as either a legacy, unprefixed JSON snapshot or a current,
+// argsEncoding-prefixed protobuf one; see argsEncoding's doc for why both are accepted.
+func unmarshalSnapshot(bs []byte) (fsmSnapshot, error) {
+	var s fsmSnapshot
+	if isLegacyJSON(bs) {
+		if err := json.Unmarshal(bs, &s); err != nil {
+			return s, fmt.Errorf("decoding snapshot: %w", err)
+		}
+		return s, nil
+	}
+	if len(bs) == 0 {
+		return s, fmt.Errorf("ippool: empty snapshot")
+	}
+	if err := checkArgsEncoding(bs); err != nil {
+		return s, err
+	}
+	var pb ippoolpb.Snapshot
+	if err := pb.UnmarshalBinary(bs[1:]); err != nil {
+		return s, fmt.Errorf("decoding snapshot: %w", err)
+	}
+	s.Version = int(pb.Version)
+	for _, p := range pb.Peers {
+		sp := snapshotPeer{NodeID: tailcfg.NodeID(p.NodeID), NextLeaseID: p.NextLeaseID}
+		for _, e := range p.Entries {
+			var addr netip.Addr
+			if err := addr.UnmarshalBinary(e.Addr); err != nil {
+				return s, fmt.Errorf("decoding snapshot entry addr: %w", err)
+			}
+			sp.Entries = append(sp.Entries, snapshotEntry{
+				Addr:     addr,
+				Domain:   e.Domain,
+				LastUsed: time.Unix(0, e.LastUsedUnixNano).UTC(),
+				LeaseID:  leaseID(e.LeaseID),
+			})
+		}
+		s.Peers = append(s.Peers, sp)
+	}
+	return s, nil
+}
@@ -0,0 +1,166 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ippool
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go4.org/netipx"
+	"tailscale.com/tailcfg"
+)
+
+// fakeSnapshotSink is a minimal raft.SnapshotSink backed by an in-memory buffer, so tests can
+// exercise Persist/Restore without a running raft cluster.
+type fakeSnapshotSink struct {
+	bytes.Buffer
+}
+
+func (f *fakeSnapshotSink) ID() string    { return "fake-snapshot" }
+func (f *fakeSnapshotSink) Cancel() error { return nil }
+func (f *fakeSnapshotSink) Close() error  { return nil }
+
+func newTestPool(t testing.TB) *ConsensusIPPool {
+	t.Helper()
+	var b netipx.IPSetBuilder
+	b.AddPrefix(netip.MustParsePrefix("100.64.0.0/24"))
+	ipSet, err := b.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipp, err := NewConsensusIPPool(ipSet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipp
+}
+
+// TestFSMSnapshotRestore checks that taking a snapshot of a pool's state and restoring it into
+// a fresh pool reproduces the same domain/address mappings.
+func TestFSMSnapshotRestore(t *testing.T) {
+	ipp := newTestPool(t)
+	nid := tailcfg.NodeID(1)
+	now := time.Now()
+	if _, err := ipp.applyCheckoutAddr(nid, "example.com", now.Add(-time.Hour), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipp.applyCheckoutAddr(nid, "example.org", now.Add(-time.Hour), now); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := ipp.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	var sink fakeSnapshotSink
+	if err := snap.Persist(&sink); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+
+	restored := newTestPool(t)
+	if err := restored.Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	wantPS, ok := ipp.perPeerMap.Load(nid)
+	if !ok {
+		t.Fatal("original pool missing peer state")
+	}
+	gotPS, ok := restored.perPeerMap.Load(nid)
+	if !ok {
+		t.Fatal("restored pool missing peer state")
+	}
+	for domain, addr := range wantPS.domainToAddr {
+		gotAddr, ok := gotPS.domainToAddr[domain]
+		if !ok || gotAddr != addr {
+			t.Errorf("domain %q: got addr %v, want %v", domain, gotAddr, addr)
+		}
+	}
+}
+
+// TestFreshFollowerCatchesUpFromSnapshot exercises the case Restore exists for: a node that
+// joins with no log history at all, and instead is brought up to date purely from a snapshot
+// sent by the leader.
+func TestFreshFollowerCatchesUpFromSnapshot(t *testing.T) {
+	leader := newTestPool(t)
+	nid := tailcfg.NodeID(7)
+	now := time.Now()
+	addr, err := leader.applyCheckoutAddr(nid, "example.com", now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := leader.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	var sink fakeSnapshotSink
+	if err := snap.Persist(&sink); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+
+	follower := newTestPool(t)
+	if err := follower.Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	ps, ok := follower.perPeerMap.Load(nid)
+	if !ok {
+		t.Fatal("follower has no state for node after restore")
+	}
+	ww, ok := ps.addrToDomain.Load(addr)
+	if !ok {
+		t.Fatalf("follower has no entry for %v after restore", addr)
+	}
+	if ww.Domain != "example.com" {
+		t.Errorf("got domain %q, want example.com", ww.Domain)
+	}
+}
+
+// TestRestoreRebuildsLeaseHeap checks that an address whose lease had already expired before a
+// snapshot was taken is still reapable after a follower restores from that snapshot, even
+// though nobody has touched the address since. Without rebuilding ps.leases in Restore, such an
+// address would be invisible to both applyRevokeLease and unusedIP's eviction fallback until
+// something happened to check it out or mark it used again -- which, for an address nobody's
+// using, never happens.
+func TestRestoreRebuildsLeaseHeap(t *testing.T) {
+	leader := newTestPool(t)
+	leader.config.ReuseDeadline = time.Minute
+	nid := tailcfg.NodeID(7)
+	base := time.Now()
+
+	// Already expired per ReuseDeadline by the time the snapshot is taken.
+	addr, err := leader.applyCheckoutAddr(nid, "idle.example.com", base.Add(-48*time.Hour), base.Add(-2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := leader.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	var sink fakeSnapshotSink
+	if err := snap.Persist(&sink); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+
+	follower := newTestPool(t)
+	follower.config.ReuseDeadline = time.Minute
+	if err := follower.Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	follower.applyRevokeLease(base)
+
+	ps, ok := follower.perPeerMap.Load(nid)
+	if !ok {
+		t.Fatal("follower has no state for node after restore")
+	}
+	if _, ok := ps.addrToDomain.Load(addr); ok {
+		t.Errorf("address %v still allocated after applyRevokeLease; restored lease heap wasn't reaped", addr)
+	}
+}